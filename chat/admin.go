@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// disconnectWhere has the hub hang up on every connected client that matches,
+// sending farewell first. it returns how many were disconnected.
+func (h *Hub) disconnectWhere(match func(*Client) bool, farewell []byte) int {
+	done := make(chan int, 1)
+	h.exec <- func() {
+		disconnected := 0
+		for client := range h.clients {
+			if !match(client) {
+				continue
+			}
+			select {
+			case client.send <- farewell:
+			default:
+			}
+			client.disconnect()
+			disconnected++
+		}
+		log.Printf("disconnecting %d clients (count=%d)\n", disconnected, h.clientCount)
+		done <- disconnected
+	}
+	return <-done
+}
+
+// clientsWhere lists the connected clients that match.
+func (h *Hub) clientsWhere(match func(*Client) bool) []*Client {
+	done := make(chan []*Client, 1)
+	h.exec <- func() {
+		matched := []*Client{}
+		for client := range h.clients {
+			if match(client) {
+				matched = append(matched, client)
+			}
+		}
+		done <- matched
+	}
+	return <-done
+}
+
+// sendWhere has the hub send payload to every connected client that matches,
+// skipping any that are backed up.
+func (h *Hub) sendWhere(match func(*Client) bool, payload []byte) {
+	h.exec <- func() {
+		for client := range h.clients {
+			if !match(client) {
+				continue
+			}
+			select {
+			case client.send <- payload:
+			default:
+			}
+		}
+	}
+}
+
+// RevokeTokenID revokes a single token by its jti, disconnecting any client using it.
+func (h *Hub) RevokeTokenID(jti string) int {
+	// we don't know when it expires, but it can't outlive a freshly issued token
+	h.revoked.revokeToken(jti, time.Now().Add(h.tokenTTL))
+	log.Printf("revoked token %s\n", jti)
+	return h.disconnectWhere(func(c *Client) bool {
+		return c.identity != nil && c.identity.TokenID == jti
+	}, EncodeAuthErrorMessage(AuthErrorRevoked, "token was revoked", false))
+}
+
+// BanUsername revokes every token for a username, and for whoever currently holds
+// it, disconnecting their clients.
+func (h *Hub) BanUsername(username string) int {
+	subject := h.names.holder(username)
+	h.revoked.banUsername(username, subject)
+	log.Printf("banned username %s (subject %s)\n", username, subject)
+	return h.disconnectWhere(func(c *Client) bool {
+		return c.identity != nil && (strings.EqualFold(c.identity.User.Username, username) || (subject != "" && c.identity.Subject == subject))
+	}, EncodeAuthErrorMessage(AuthErrorRevoked, "identity was revoked", false))
+}
+
+// UnbanUsername lifts a ban, returning whether there was one.
+func (h *Hub) UnbanUsername(username string) bool {
+	log.Printf("unbanning username %s\n", username)
+	return h.revoked.unbanUsername(username, h.names.holder(username))
+}
+
+// GrantRole assigns a role to whoever currently holds username, re-issuing tokens
+// to their connected clients so it takes effect right away. it returns how many
+// clients were updated, or an error if nobody holds the name.
+func (h *Hub) GrantRole(username, role string) (int, error) {
+	if !validRole(role) {
+		return 0, fmt.Errorf("unknown role %s", role)
+	}
+	subject := h.names.holder(username)
+	if subject == "" {
+		return 0, fmt.Errorf("no live identity holds username %s", username)
+	}
+	h.roles.grant(subject, role)
+	log.Printf("granted role %s to %s (subject %s)\n", role, username, subject)
+
+	type result struct {
+		updated int
+		err     error
+	}
+	done := make(chan result, 1)
+	// clients' identities belong to the hub goroutine, see Hub.identityOf
+	h.exec <- func() {
+		updated := 0
+		for c := range h.clients {
+			if c.identity == nil || c.identity.Subject != subject {
+				continue
+			}
+			promoted := *c.identity
+			promoted.Role = role
+			id, signedToken, err := signUserJWT(h.keys, &promoted, h.tokenTTL)
+			if err != nil {
+				done <- result{updated, err}
+				return
+			}
+			// the name is theirs for as long as the new token lasts
+			if err := h.names.reserve(id.User.Username, id.Subject, id.ExpiresAt); err != nil {
+				log.Printf("warn: couldn't extend username %s for %s - %s\n", id.User.Username, id.Subject, err)
+			}
+			c.User = id.User
+			c.identity = id
+			c.setTokenExpiry(id.ExpiresAt, h.tokenRenewWithin)
+			select {
+			case c.send <- EncodeAuthMessage(signedToken, nil):
+			default:
+				// too backed up to hear about it; the grant applies when it next authenticates
+			}
+			updated++
+		}
+		done <- result{updated, nil}
+	}
+	r := <-done
+	return r.updated, r.err
+}
+
+type adminRequest struct {
+	Token    string `json:"token"`
+	JTI      string `json:"jti"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+
+	Channels  []string `json:"channels"`
+	ExpiresIn string   `json:"expires_in"`
+	MaxUses   int      `json:"max_uses"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(encode(v))
+}
+
+func adminError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// ServeAdmin handles the admin api under /admin/, authenticated with ADMIN_TOKEN
+// as a bearer token. it's disabled entirely when no token is configured.
+//
+//	POST   /admin/revocations/tokens            {"token": "<jwt>"} or {"jti": "..."}
+//	POST   /admin/revocations/users             {"username": "..."}
+//	DELETE /admin/revocations/users/<username>
+//	POST   /admin/roles                         {"username": "...", "role": "visitor|trusted|moderator"}
+//	POST   /admin/invites                       {"channels": ["..."], "expires_in": "72h", "max_uses": 10}
+func ServeAdmin(cfg *Config, hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if cfg.Server.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(cfg.Server.AdminToken)) != 1 {
+		adminError(w, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+
+	var body adminRequest
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			adminError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/admin/")
+	switch {
+	case path == "revocations/tokens" && r.Method == "POST":
+		jti := body.JTI
+		if body.Token != "" {
+			// only tokens we issued are worth revoking; expired ones are dead already
+			id, _, err := verifySignedJWT(hub.keys, body.Token)
+			if err != nil {
+				adminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			jti = id.TokenID
+		}
+		if jti == "" {
+			adminError(w, http.StatusBadRequest, "token or jti required (tokens without a jti can only be revoked by username)")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"jti": jti, "disconnected": hub.RevokeTokenID(jti)})
+	case path == "revocations/users" && r.Method == "POST":
+		if body.Username == "" {
+			adminError(w, http.StatusBadRequest, "username required")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"username": body.Username, "disconnected": hub.BanUsername(body.Username)})
+	case strings.HasPrefix(path, "revocations/users/") && r.Method == "DELETE":
+		username := strings.TrimPrefix(path, "revocations/users/")
+		if !hub.UnbanUsername(username) {
+			adminError(w, http.StatusNotFound, "username is not banned")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"username": username})
+	case path == "roles" && r.Method == "POST":
+		if body.Username == "" || body.Role == "" {
+			adminError(w, http.StatusBadRequest, "username and role required")
+			return
+		}
+		updated, err := hub.GrantRole(body.Username, body.Role)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"username": body.Username, "role": body.Role, "updated": updated})
+	case path == "invites" && r.Method == "POST":
+		var ttl time.Duration
+		if body.ExpiresIn != "" {
+			var err error
+			if ttl, err = time.ParseDuration(body.ExpiresIn); err != nil || ttl <= 0 {
+				adminError(w, http.StatusBadRequest, "expires_in must be a positive duration, eg: 72h")
+				return
+			}
+		}
+		inviteURL, expiresAt, err := hub.CreateInvite(body.Channels, ttl, body.MaxUses)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"url": inviteURL, "channels": body.Channels, "expires_at": expiresAt.Unix(), "max_uses": body.MaxUses})
+	default:
+		adminError(w, http.StatusNotFound, "unknown admin operation")
+	}
+}
@@ -0,0 +1,143 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newAdminHub is a hub with hs256 keys, whose exec work runs on a stand-in for
+// the hub goroutine until exec is closed.
+func newAdminHub(t *testing.T) *Hub {
+	keys := newTestKeyring(t)
+	names, _ := newUsernameRegistry("")
+	roles, _ := newRoleGrants("")
+	h := &Hub{
+		keys:     keys,
+		names:    names,
+		roles:    roles,
+		tokenTTL: time.Hour,
+		exec:     make(chan func()),
+		clients:  map[*Client]bool{},
+	}
+	go func() {
+		for f := range h.exec {
+			f()
+		}
+	}()
+	return h
+}
+
+func newAdminClient(h *Hub, subject, username string, expiresAt time.Time) *Client {
+	user := &User{Username: username}
+	c := &Client{
+		hub:         h,
+		send:        make(chan []byte, 10),
+		gone:        make(chan struct{}),
+		kick:        make(chan struct{}),
+		tokenExpiry: make(chan tokenLifetime, 1),
+		User:        user,
+		identity:    &identity{Subject: subject, User: user, Role: RoleVisitor, ExpiresAt: expiresAt},
+
+		subscriptions: map[string]bool{},
+	}
+	h.exec <- func() { h.clients[c] = true }
+	return c
+}
+
+// run with -race: the hub reads clients' identities while roles are granted
+func TestGrantRole(t *testing.T) {
+	h := newAdminHub(t)
+	defer close(h.exec)
+	soon := time.Now().Add(time.Minute)
+	if err := h.names.reserve("bob", "anon|bob", soon); err != nil {
+		t.Fatal(err)
+	}
+	bob := newAdminClient(h, "anon|bob", "bob", soon)
+	other := newAdminClient(h, "anon|eve", "eve", soon)
+
+	stop, stopped := make(chan bool), make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				h.clientsWhere(func(c *Client) bool { return c.identity.Role == RoleModerator })
+			}
+		}
+	}()
+	updated, err := h.GrantRole("bob", RoleModerator)
+	close(stop)
+	<-stopped
+	if err != nil || updated != 1 {
+		t.Fatalf("GrantRole = %d, %v; want 1 client updated", updated, err)
+	}
+
+	moderators := h.clientsWhere(func(c *Client) bool { return c.identity.Role == RoleModerator })
+	if len(moderators) != 1 || moderators[0] != bob {
+		t.Errorf("moderators = %v, want just bob", moderators)
+	}
+	select {
+	case payload := <-bob.send:
+		var auth struct {
+			Type  string `json:"type"`
+			Token string `json:"token"`
+		}
+		json.Unmarshal(payload, &auth)
+		id, _, err := verifySignedJWT(h.keys, auth.Token)
+		if err != nil || id.Role != RoleModerator {
+			t.Errorf("re-issued token %s: %+v, %v", payload, id, err)
+		}
+	default:
+		t.Error("bob wasn't sent a new token")
+	}
+	if len(other.send) != 0 {
+		t.Error("eve was sent a token")
+	}
+
+	// the name can't be claimed while the new token is still good
+	done := make(chan time.Time)
+	h.exec <- func() { done <- bob.identity.ExpiresAt }
+	expiresAt := <-done
+	h.names.mu.Lock()
+	reserved := h.names.byName["bob"].ExpiresAt
+	h.names.mu.Unlock()
+	if !reserved.Equal(expiresAt) || !reserved.After(soon) {
+		t.Errorf("bob is reserved until %s, want %s", reserved, expiresAt)
+	}
+}
+
+func TestDisconnectWhereLeavesSendOpen(t *testing.T) {
+	h := newAdminHub(t)
+	defer close(h.exec)
+	soon := time.Now().Add(time.Minute)
+	bob := newAdminClient(h, "anon|bob", "bob", soon)
+	eve := newAdminClient(h, "anon|eve", "eve", soon)
+
+	disconnected := h.disconnectWhere(func(c *Client) bool { return c == bob }, []byte("bye"))
+	if disconnected != 1 {
+		t.Fatalf("disconnected %d clients, want 1", disconnected)
+	}
+	select {
+	case <-bob.kick:
+	default:
+		t.Error("bob's writer wasn't told to hang up")
+	}
+	select {
+	case <-eve.kick:
+		t.Error("eve's writer was told to hang up")
+	default:
+	}
+	// its messages may still be being handled, so send stays open
+	if payload, ok := <-bob.send; !ok || string(payload) != "bye" {
+		t.Errorf("farewell = %q, %v", payload, ok)
+	}
+	bob.send <- []byte("late reply")
+	if still := h.clientsWhere(func(c *Client) bool { return c == bob }); len(still) != 1 {
+		t.Error("bob was unregistered before readPump hung up")
+	}
+	// twice is fine
+	bob.disconnect()
+}
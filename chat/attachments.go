@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"net/url"
+	"regexp"
+
+	"github.com/nlopes/slack"
+)
+
+// what we pass along of a message's legacy attachments. everything is plain
+// text for the client to escape, and urls are limited to http(s).
+type chatAttachment struct {
+	Color      string                `json:"color,omitempty"`
+	Pretext    string                `json:"pretext,omitempty"`
+	AuthorName string                `json:"author_name,omitempty"`
+	AuthorLink string                `json:"author_link,omitempty"`
+	AuthorIcon string                `json:"author_icon,omitempty"`
+	Title      string                `json:"title,omitempty"`
+	TitleLink  string                `json:"title_link,omitempty"`
+	Text       string                `json:"text,omitempty"`
+	Fields     []chatAttachmentField `json:"fields,omitempty"`
+	ImageURL   string                `json:"image_url,omitempty"`
+	ThumbURL   string                `json:"thumb_url,omitempty"`
+	Footer     string                `json:"footer,omitempty"`
+	Fallback   string                `json:"fallback,omitempty"`
+}
+type chatAttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short,omitempty"`
+}
+
+// file_share metadata. the file itself is private to the workspace, but
+// visitors who can see it can fetch it through us.
+type chatFile struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Title    string `json:"title,omitempty"`
+	Mimetype string `json:"mimetype,omitempty"`
+	Filetype string `json:"filetype,omitempty"`
+	Size     int    `json:"size"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	// our proxy for it, see ServeFile
+	URL string `json:"url"`
+}
+
+var hexColor = regexp.MustCompile(`^#?[0-9a-fA-F]{6}$`)
+
+// slack's named attachment colours
+var namedColors = map[string]string{
+	"good":    "#2eb886",
+	"warning": "#daa038",
+	"danger":  "#a30200",
+}
+
+func sanitizeColor(color string) string {
+	if named, ok := namedColors[color]; ok {
+		return named
+	}
+	if !hexColor.MatchString(color) {
+		return ""
+	}
+	if color[0] != '#' {
+		color = "#" + color
+	}
+	return color
+}
+
+// sanitizeURL drops anything but absolute http(s) urls, eg: javascript: links.
+func sanitizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+func newChatAttachments(attachments []slack.Attachment) []chatAttachment {
+	var encoded []chatAttachment
+	for _, a := range attachments {
+		ca := chatAttachment{
+			Color:      sanitizeColor(a.Color),
+			Pretext:    a.Pretext,
+			AuthorName: a.AuthorName,
+			AuthorLink: sanitizeURL(a.AuthorLink),
+			AuthorIcon: sanitizeURL(a.AuthorIcon),
+			Title:      a.Title,
+			TitleLink:  sanitizeURL(a.TitleLink),
+			Text:       a.Text,
+			ImageURL:   sanitizeURL(a.ImageURL),
+			ThumbURL:   sanitizeURL(a.ThumbURL),
+			Footer:     a.Footer,
+			Fallback:   a.Fallback,
+		}
+		for _, f := range a.Fields {
+			ca.Fields = append(ca.Fields, chatAttachmentField{Title: f.Title, Value: f.Value, Short: f.Short})
+		}
+		encoded = append(encoded, ca)
+	}
+	return encoded
+}
+
+func newChatFile(f *slack.File) *chatFile {
+	if f == nil {
+		return nil
+	}
+	return &chatFile{
+		ID:       f.ID,
+		Name:     f.Name,
+		Title:    f.Title,
+		Mimetype: f.Mimetype,
+		Filetype: f.Filetype,
+		Size:     f.Size,
+		Width:    f.OriginalW,
+		Height:   f.OriginalH,
+		URL:      fileProxyURL(f.ID),
+	}
+}
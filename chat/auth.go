@@ -3,6 +3,7 @@ package chat
 import (
 	"crypto/subtle"
 	"fmt"
+	"time"
 
 	randomdata "github.com/Pallinder/go-randomdata"
 	jwt "github.com/dgrijalva/jwt-go"
@@ -12,56 +13,204 @@ import (
 const TokenVersion = "1"
 const TokenISS = "cut-me-some-slack"
 
-func generateSignedJWT(hmacKey []byte) (*User, string, error) {
-	user := User{Username: fmt.Sprintf("%s-%s-%d", randomdata.Adjective(), randomdata.Noun(), randomdata.Number(5000))}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// how many random usernames we try before giving up on a new identity
+const maxUsernameAttempts = 10
+
+// identity is what a visitor token vouches for.
+type identity struct {
+	// anonymous identities use a random subject (or, for old tokens, their username);
+	// oidc ones use the provider's. it's stable across username changes.
+	Subject string
+	User    *User
+	Role    string
+
+	// channels (names or ids) the identity was invited into. nil means it
+	// isn't scoped by an invite.
+	Channels []string
+
+	// TokenID (the jti claim) is unique per issued token
+	TokenID   string
+	ExpiresAt time.Time
+}
+
+// generateSignedJWT mints a new anonymous identity with a random, unreserved username.
+// the subject is random too, so the identity survives a change of username.
+func generateSignedJWT(keys *keyring, names *usernameRegistry, ttl time.Duration) (*identity, string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	subject := "anon|" + id
+	username, err := reserveRandomUsername(names, subject, time.Now().Add(ttl))
+	if err != nil {
+		return nil, "", err
+	}
+	return signUserJWT(keys, &identity{Subject: subject, User: &User{Username: username}, Role: RoleVisitor}, ttl)
+}
+
+// reserveRandomUsername picks an unreserved username for subject, eg: happy-otter-42.
+func reserveRandomUsername(names *usernameRegistry, subject string, expiresAt time.Time) (string, error) {
+	for attempt := 1; ; attempt++ {
+		username := fmt.Sprintf("%s-%s-%d", randomdata.Adjective(), randomdata.Noun(), randomdata.Number(5000))
+		err := names.reserve(username, subject, expiresAt)
+		if err == nil {
+			return username, nil
+		} else if attempt == maxUsernameAttempts {
+			return "", fmt.Errorf("no free username after %d attempts: %s", attempt, err)
+		}
+	}
+}
+
+// signUserJWT issues a new token for an identity, valid from now until ttl elapses,
+// returning a copy of the identity with its fresh token id and expiry.
+// it's used for brand new identities, for renewing ones that are about to expire
+// and for migrating ones signed with a rotated-out key.
+func signUserJWT(keys *keyring, id *identity, ttl time.Duration) (*identity, string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	signed := *id
+	signed.TokenID = jti
+	signed.ExpiresAt = time.Unix(now.Add(ttl).Unix(), 0)
+
+	claims := jwt.MapClaims{
 		"iss":  TokenISS,
-		"sub":  user.Username,
-		"user": user,
+		"sub":  signed.Subject,
+		"jti":  signed.TokenID,
+		"user": signed.User,
+		"role": signed.Role,
 		"tv":   TokenVersion,
-		//"exp": TODO
-		//"nbf": time.Date(2015, 10, 10, 12, 0, 0, 0, time.UTC).Unix(),
-	})
+		"iat":  now.Unix(),
+		"nbf":  now.Unix(),
+		"exp":  signed.ExpiresAt.Unix(),
+	}
+	if signed.Channels != nil {
+		claims["channels"] = signed.Channels
+	}
+	token := jwt.NewWithClaims(keys.current.method, claims)
+	token.Header["kid"] = keys.current.id
+
+	tokenString, err := token.SignedString(keys.current.signKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return &signed, tokenString, nil
+}
+
+// machine-readable reasons sent to clients in auth-error events
+const (
+	AuthErrorMalformed     = "malformed"
+	AuthErrorBadSignature  = "bad-signature"
+	AuthErrorExpired       = "expired"
+	AuthErrorWrongVersion  = "wrong-version"
+	AuthErrorInvalidClaims = "invalid-claims"
+	AuthErrorUsernameTaken = "username-taken"
+	AuthErrorRevoked       = "revoked"
+)
 
-	tokenString, err := token.SignedString(hmacKey)
-	return &user, tokenString, err
+// AuthError is a token verification failure along with why it happened.
+type AuthError struct {
+	Reason string
+	Err    error
 }
 
-func verifySignedJWT(hmacKey []byte, tokenString string) (*User, *jwt.Token, error) {
-	var user *User
-	// TODO maybe just use jwt.ParseWithClaims()
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func authErrorf(reason, format string, args ...interface{}) *AuthError {
+	return &AuthError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// authErrorFromParse classifies errors out of jwt.Parse. a bad signature wins
+// over anything else so that forged tokens aren't reported as merely expired.
+func authErrorFromParse(err error) *AuthError {
+	vErr, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return &AuthError{Reason: AuthErrorMalformed, Err: err}
+	}
+	switch {
+	case vErr.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+		return &AuthError{Reason: AuthErrorBadSignature, Err: err}
+	case vErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return &AuthError{Reason: AuthErrorMalformed, Err: err}
+	case vErr.Errors&jwt.ValidationErrorExpired != 0:
+		return &AuthError{Reason: AuthErrorExpired, Err: err}
+	default:
+		return &AuthError{Reason: AuthErrorInvalidClaims, Err: err}
+	}
+}
+
+// verifySignedJWT checks a token's signature and claims. errors are always *AuthError.
+func verifySignedJWT(keys *keyring, tokenString string) (*identity, *jwt.Token, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		// find the key it was signed with, validating the signing method against it
+		key, err := keys.lookup(token)
+		if err != nil {
+			return nil, err
 		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, token, authErrorFromParse(err)
+	}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			return nil, fmt.Errorf("Malformed claims received: %v", token.Claims)
-		}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, token, authErrorf(AuthErrorMalformed, "Malformed claims received: %v", token.Claims)
+	}
 
-		// validate issuer
-		if !claims.VerifyIssuer(TokenISS, true) {
-			return nil, fmt.Errorf("Unexpected token issuer: %v", claims["iss"])
-		}
+	// validate issuer
+	if !claims.VerifyIssuer(TokenISS, true) {
+		return nil, token, authErrorf(AuthErrorInvalidClaims, "Unexpected token issuer: %v", claims["iss"])
+	}
+	// identity tokens have no audience; invites do
+	if _, ok := claims["aud"]; ok {
+		return nil, token, authErrorf(AuthErrorInvalidClaims, "Unexpected token audience: %v", claims["aud"])
+	}
 
-		// validate token version
-		tvRaw, _ := claims["tv"].(string)
-		if subtle.ConstantTimeCompare([]byte(tvRaw), []byte(TokenVersion)) != 1 {
-			return nil, fmt.Errorf("Unexpected token version: %s", tvRaw)
-		}
+	// validate token version
+	tvRaw, _ := claims["tv"].(string)
+	if subtle.ConstantTimeCompare([]byte(tvRaw), []byte(TokenVersion)) != 1 {
+		return nil, token, authErrorf(AuthErrorWrongVersion, "Unexpected token version: %s", tvRaw)
+	}
 
-		// extract/validate the user
-		var u User
-		err := mapstructure.Decode(claims["user"], &u)
-		if err != nil || u.Username == "" {
-			return nil, fmt.Errorf("Invalid user claim: %v", claims["user"])
-		}
-		user = &u
+	// jwt.Parse has already rejected expired or not-yet-valid tokens, but only checks
+	// claims that are present. we require all three so that tokens minted before
+	// expiry existed are rejected too.
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return nil, token, authErrorf(AuthErrorExpired, "Token missing exp")
+	}
+	if !claims.VerifyIssuedAt(now, true) || !claims.VerifyNotBefore(now, true) {
+		return nil, token, authErrorf(AuthErrorInvalidClaims, "Token missing iat or nbf")
+	}
 
-		// TODO exp
-		return hmacKey, nil
-	})
-	return user, token, err
+	// extract/validate the user
+	var user User
+	err = mapstructure.Decode(claims["user"], &user)
+	if err != nil || user.Username == "" {
+		return nil, token, authErrorf(AuthErrorInvalidClaims, "Invalid user claim: %v", claims["user"])
+	}
+
+	// tokens from before roles existed are plain visitors
+	id := &identity{User: &user, Role: RoleVisitor}
+	if role, ok := claims["role"].(string); ok {
+		if !validRole(role) {
+			return nil, token, authErrorf(AuthErrorInvalidClaims, "Invalid role claim: %s", role)
+		}
+		id.Role = role
+	}
+	if raw, ok := claims["channels"]; ok {
+		if id.Channels, ok = stringsClaim(raw); !ok {
+			return nil, token, authErrorf(AuthErrorInvalidClaims, "Invalid channels claim: %v", raw)
+		}
+	}
+	id.Subject, _ = claims["sub"].(string)
+	id.TokenID, _ = claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	id.ExpiresAt = time.Unix(int64(exp), 0)
+	return id, token, nil
 }
@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// newTestKeyring is an hs256 keyring signing with kid k1.
+func newTestKeyring(t *testing.T) *keyring {
+	cfg := &Config{}
+	cfg.Server.JWTKeyID, cfg.Server.JWTAlgorithm, cfg.Server.JWTSecret = "k1", "HS256", "secret"
+	keys, err := newKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// identityClaims are the claims of a valid identity token, until changed.
+func identityClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":  TokenISS,
+		"sub":  "anon|bob",
+		"jti":  "t1",
+		"user": map[string]interface{}{"username": "bob"},
+		"role": RoleVisitor,
+		"tv":   TokenVersion,
+		"iat":  now.Unix(),
+		"nbf":  now.Unix(),
+		"exp":  now.Add(time.Hour).Unix(),
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerifySignedJWTClaims(t *testing.T) {
+	keys := newTestKeyring(t)
+	hour := time.Hour
+	tests := []struct {
+		name   string
+		change func(jwt.MapClaims)
+		reason string
+	}{
+		{"valid", func(jwt.MapClaims) {}, ""},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-hour).Unix() }, AuthErrorExpired},
+		{"missing exp", func(c jwt.MapClaims) { delete(c, "exp") }, AuthErrorExpired},
+		{"missing iat", func(c jwt.MapClaims) { delete(c, "iat") }, AuthErrorInvalidClaims},
+		{"missing nbf", func(c jwt.MapClaims) { delete(c, "nbf") }, AuthErrorInvalidClaims},
+		{"not valid yet", func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(hour).Unix() }, AuthErrorInvalidClaims},
+		{"issued in the future", func(c jwt.MapClaims) { c["iat"] = time.Now().Add(hour).Unix() }, AuthErrorInvalidClaims},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "someone-else" }, AuthErrorInvalidClaims},
+		{"missing issuer", func(c jwt.MapClaims) { delete(c, "iss") }, AuthErrorInvalidClaims},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "invite" }, AuthErrorInvalidClaims},
+		{"wrong version", func(c jwt.MapClaims) { c["tv"] = "0" }, AuthErrorWrongVersion},
+		{"missing user", func(c jwt.MapClaims) { delete(c, "user") }, AuthErrorInvalidClaims},
+		{"empty username", func(c jwt.MapClaims) { c["user"] = map[string]interface{}{"username": ""} }, AuthErrorInvalidClaims},
+		{"bad role", func(c jwt.MapClaims) { c["role"] = "admin" }, AuthErrorInvalidClaims},
+		{"bad channels", func(c jwt.MapClaims) { c["channels"] = "general" }, AuthErrorInvalidClaims},
+	}
+	for _, test := range tests {
+		claims := identityClaims()
+		test.change(claims)
+		token := signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "k1", claims)
+		id, _, err := verifySignedJWT(keys, token)
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: rejected: %s", test.name, err)
+			} else if id.Subject != "anon|bob" || id.User.Username != "bob" || id.TokenID != "t1" || id.Role != RoleVisitor {
+				t.Errorf("%s: got %+v", test.name, id)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: accepted", test.name)
+			continue
+		}
+		if reason := err.(*AuthError).Reason; reason != test.reason {
+			t.Errorf("%s: rejected as %s, want %s (%s)", test.name, reason, test.reason, err)
+		}
+	}
+}
+
+func TestVerifySignedJWTMalformed(t *testing.T) {
+	keys := newTestKeyring(t)
+	for _, token := range []string{"", "not-a-token", "a.b.c"} {
+		_, _, err := verifySignedJWT(keys, token)
+		if err == nil {
+			t.Errorf("%q: accepted", token)
+			continue
+		}
+		if reason := err.(*AuthError).Reason; reason != AuthErrorMalformed {
+			t.Errorf("%q: rejected as %s, want %s", token, reason, AuthErrorMalformed)
+		}
+	}
+}
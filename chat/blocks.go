@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+
+	"github.com/nlopes/slack"
+)
+
+// slackMessage is a message as the web api sends it, along with the block
+// kit blocks our slack client doesn't decode.
+type slackMessage struct {
+	slack.Message
+	Blocks []json.RawMessage `json:"blocks"`
+}
+
+// what we pass along of a message's block kit blocks: the text and images of
+// section, context, header, divider and image blocks. anything interactive
+// (buttons, menus, inputs) is left out since visitors can't use it, and so
+// are rich_text blocks, which only repeat the message's text.
+type chatBlock struct {
+	// section, context, header, divider or image
+	Type string `json:"type"`
+	// section and header text
+	Text *chatBlockText `json:"text,omitempty"`
+	// a section's fields, shown two to a row
+	Fields []chatBlockText `json:"fields,omitempty"`
+	// a context block's text, in order
+	Elements []chatBlockText `json:"elements,omitempty"`
+	// image blocks, and a section's image accessory. only http(s) urls.
+	ImageURL string `json:"image_url,omitempty"`
+	AltText  string `json:"alt_text,omitempty"`
+	Title    string `json:"title,omitempty"`
+}
+
+// chatBlockText is a text object, resolved like a message's text. plain_text
+// is a single text segment, and shouldn't be formatted.
+type chatBlockText struct {
+	// mrkdwn or plain_text
+	Type     string        `json:"type"`
+	Segments []chatSegment `json:"segments"`
+}
+
+type slackTextObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackBlock has the parts of a block we can show. the rest of it varies too
+// much by type to decode, so elements and accessories are decoded one by one.
+type slackBlock struct {
+	Type      string            `json:"type"`
+	Text      *slackTextObject  `json:"text"`
+	Fields    []slackTextObject `json:"fields"`
+	Elements  []json.RawMessage `json:"elements"`
+	Accessory json.RawMessage   `json:"accessory"`
+	ImageURL  string            `json:"image_url"`
+	AltText   string            `json:"alt_text"`
+	Title     *slackTextObject  `json:"title"`
+}
+
+// slackBlockElement is a text object or an image element; buttons and the
+// like don't decode.
+type slackBlockElement struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+func newChatBlockText(t *slackTextObject, names mentionResolver) *chatBlockText {
+	if t == nil || t.Text == "" {
+		return nil
+	}
+	switch t.Type {
+	case "mrkdwn":
+		return &chatBlockText{Type: t.Type, Segments: tokenizeMrkdwn(t.Text, names)}
+	case "plain_text":
+		return &chatBlockText{Type: t.Type, Segments: []chatSegment{{Type: "text", Text: t.Text}}}
+	}
+	return nil
+}
+
+func newChatBlocks(raw []json.RawMessage, names mentionResolver) []chatBlock {
+	var encoded []chatBlock
+	for _, r := range raw {
+		var b slackBlock
+		if err := json.Unmarshal(r, &b); err != nil {
+			continue
+		}
+		cb := chatBlock{Type: b.Type}
+		switch b.Type {
+		case "section":
+			cb.Text = newChatBlockText(b.Text, names)
+			for i := range b.Fields {
+				if t := newChatBlockText(&b.Fields[i], names); t != nil {
+					cb.Fields = append(cb.Fields, *t)
+				}
+			}
+			var accessory slackBlockElement
+			if json.Unmarshal(b.Accessory, &accessory) == nil && accessory.Type == "image" {
+				cb.ImageURL, cb.AltText = sanitizeURL(accessory.ImageURL), accessory.AltText
+			}
+			if cb.Text == nil && cb.Fields == nil && cb.ImageURL == "" {
+				continue
+			}
+		case "context":
+			// context images are little icons, which we leave out
+			for _, e := range b.Elements {
+				var element slackBlockElement
+				if json.Unmarshal(e, &element) != nil {
+					continue
+				}
+				if t := newChatBlockText(&slackTextObject{Type: element.Type, Text: element.Text}, names); t != nil {
+					cb.Elements = append(cb.Elements, *t)
+				}
+			}
+			if cb.Elements == nil {
+				continue
+			}
+		case "header":
+			if cb.Text = newChatBlockText(b.Text, names); cb.Text == nil {
+				continue
+			}
+		case "divider":
+		case "image":
+			if cb.ImageURL = sanitizeURL(b.ImageURL); cb.ImageURL == "" {
+				continue
+			}
+			cb.AltText = b.AltText
+			if b.Title != nil {
+				cb.Title = b.Title.Text
+			}
+		default:
+			continue
+		}
+		encoded = append(encoded, cb)
+	}
+	return encoded
+}
+
+// channelHistory is GetChannelHistory, keeping blocks.
+func (h *Hub) channelHistory(channelID string, count int) ([]slackMessage, error) {
+	var result struct {
+		Messages []slackMessage `json:"messages"`
+	}
+	values := url.Values{"token": {h.slackToken}, "channel": {channelID}, "count": {strconv.Itoa(count)}}
+	if err := callSlack("channels.history", values, &result); err != nil {
+		return nil, err
+	}
+	return result.Messages, nil
+}
+
+// threadReplies is GetChannelReplies, keeping blocks.
+func (h *Hub) threadReplies(channelID, threadTs string) ([]slackMessage, error) {
+	var result struct {
+		Messages []slackMessage `json:"messages"`
+	}
+	values := url.Values{"token": {h.slackToken}, "channel": {channelID}, "thread_ts": {threadTs}}
+	if err := callSlack("channels.replies", values, &result); err != nil {
+		return nil, err
+	}
+	return result.Messages, nil
+}
+
+// messageBlocks fetches the blocks of a message that came over rtm, whose
+// events our slack client decodes without them. blocks we can show come from
+// bots and apps: people's messages only have rich_text, and visitors' none.
+func (h *Hub) messageBlocks(channelID string, m *slack.Msg) []chatBlock {
+	if m.SubType != "bot_message" && m.BotID == "" {
+		return nil
+	}
+	if h.postedBy(channelID, &slack.Message{Msg: *m}) != "" {
+		return nil
+	}
+	var messages []slackMessage
+	var err error
+	if m.ThreadTimestamp != "" && m.ThreadTimestamp != m.Timestamp {
+		messages, err = h.threadReplies(channelID, m.ThreadTimestamp)
+	} else {
+		var result struct {
+			Messages []slackMessage `json:"messages"`
+		}
+		values := url.Values{
+			"token":     {h.slackToken},
+			"channel":   {channelID},
+			"latest":    {m.Timestamp},
+			"oldest":    {m.Timestamp},
+			"inclusive": {"1"},
+			"count":     {"1"},
+		}
+		err = callSlack("channels.history", values, &result)
+		messages = result.Messages
+	}
+	if err != nil {
+		log.Printf("error: couldn't fetch blocks of %s in %s - %s\n", m.Timestamp, channelID, err)
+		return nil
+	}
+	for _, message := range messages {
+		if message.Timestamp == m.Timestamp {
+			return newChatBlocks(message.Blocks, h)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+func TestNewChatBlocks(t *testing.T) {
+	mrkdwn := func(segments ...chatSegment) chatBlockText {
+		return chatBlockText{Type: "mrkdwn", Segments: segments}
+	}
+	text := func(s string) chatSegment {
+		return chatSegment{Type: "text", Text: s}
+	}
+	plain := func(s string) *chatBlockText {
+		return &chatBlockText{Type: "plain_text", Segments: []chatSegment{text(s)}}
+	}
+	tests := []struct {
+		name  string
+		block string
+		want  []chatBlock
+	}{
+		{"section", `{"type":"section","text":{"type":"mrkdwn","text":"hi <@U1> &lt;b&gt;"}}`, []chatBlock{
+			{Type: "section", Text: &chatBlockText{Type: "mrkdwn", Segments: []chatSegment{text("hi "), {Type: "user", Text: "@alice", ID: "U1"}, text(" <b>")}}},
+		}},
+		{"plain text section", `{"type":"section","text":{"type":"plain_text","text":"*as is*","emoji":true}}`, []chatBlock{
+			{Type: "section", Text: plain("*as is*")},
+		}},
+		{"section fields", `{"type":"section","fields":[{"type":"mrkdwn","text":"*a*"},{"type":"plain_text","text":""},{"type":"mrkdwn","text":"b"}]}`, []chatBlock{
+			{Type: "section", Fields: []chatBlockText{mrkdwn(text("*a*")), mrkdwn(text("b"))}},
+		}},
+		{"section image", `{"type":"section","text":{"type":"mrkdwn","text":"a"},"accessory":{"type":"image","image_url":"https://example.com/a.png","alt_text":"a"}}`, []chatBlock{
+			{Type: "section", Text: &chatBlockText{Type: "mrkdwn", Segments: []chatSegment{text("a")}}, ImageURL: "https://example.com/a.png", AltText: "a"},
+		}},
+		{"section button", `{"type":"section","text":{"type":"mrkdwn","text":"a"},"accessory":{"type":"button","text":{"type":"plain_text","text":"Click"},"url":"https://example.com"}}`, []chatBlock{
+			{Type: "section", Text: &chatBlockText{Type: "mrkdwn", Segments: []chatSegment{text("a")}}},
+		}},
+		{"section javascript image", `{"type":"section","accessory":{"type":"image","image_url":"javascript:alert(1)","alt_text":"x"}}`, nil},
+		{"context", `{"type":"context","elements":[{"type":"image","image_url":"https://example.com/i.png","alt_text":"i"},{"type":"mrkdwn","text":":party: by <!here>"}]}`, []chatBlock{
+			{Type: "context", Elements: []chatBlockText{mrkdwn(
+				chatSegment{Type: "emoji", Text: ":party:", Name: "party", URL: "https://emoji.example.com/party.png"},
+				text(" by "),
+				chatSegment{Type: "special", Text: "@here", Name: "here"},
+			)}},
+		}},
+		{"context of images", `{"type":"context","elements":[{"type":"image","image_url":"https://example.com/i.png","alt_text":"i"}]}`, nil},
+		{"header", `{"type":"header","text":{"type":"plain_text","text":"News"}}`, []chatBlock{{Type: "header", Text: plain("News")}}},
+		{"divider", `{"type":"divider"}`, []chatBlock{{Type: "divider"}}},
+		{"image", `{"type":"image","image_url":"https://example.com/a.png","alt_text":"alt","title":{"type":"plain_text","text":"title"}}`, []chatBlock{
+			{Type: "image", ImageURL: "https://example.com/a.png", AltText: "alt", Title: "title"},
+		}},
+		{"data image", `{"type":"image","image_url":"data:image/png;base64,AAAA","alt_text":"alt"}`, nil},
+		{"rich text", `{"type":"rich_text","elements":[{"type":"rich_text_section","elements":[{"type":"text","text":"hi"}]}]}`, nil},
+		{"actions", `{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Click"}}]}`, nil},
+		{"malformed", `{"type":"section","text":"not an object"}`, nil},
+	}
+	for _, test := range tests {
+		got := newChatBlocks([]json.RawMessage{json.RawMessage(test.block)}, testNames{})
+		if !reflect.DeepEqual(got, test.want) {
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(test.want)
+			t.Errorf("%s: got %s, want %s", test.name, gotJSON, wantJSON)
+		}
+	}
+}
+
+// newBlocksHub is a hub with a visible #general (C1).
+func newBlocksHub(t *testing.T) *Hub {
+	general := slack.Channel{}
+	general.ID, general.Name = "C1", "general"
+	channels, err := newChannelFilter(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts, _ := newVisitorPosts("", 0)
+	uploads, _ := newVisitorUploads("")
+	return &Hub{
+		slack:     slack.New("token"),
+		slackInfo: &slack.Info{User: &slack.UserDetails{ID: "UME"}, Channels: []slack.Channel{general}},
+		channels:  channels,
+		posts:     posts,
+		uploads:   uploads,
+	}
+}
+
+var testBlocks = []map[string]interface{}{
+	{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": "deploy *done*"}},
+}
+
+func TestHistoryKeepsBlocks(t *testing.T) {
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		return map[string]interface{}{"ok": true, "messages": []map[string]interface{}{
+			{"type": "message", "subtype": "bot_message", "username": "deploybot", "ts": "1.2", "blocks": testBlocks},
+			{"type": "message", "subtype": "bot_message", "username": "emptybot", "ts": "1.1"},
+		}}
+	})
+	defer f.Close()
+	h := newBlocksHub(t)
+
+	previous := h.previousMessages("C1", 10, nil)
+	if len(previous) != 1 {
+		t.Fatalf("got %d messages, want just the one with blocks", len(previous))
+	}
+	var m chatMessage
+	if err := json.Unmarshal(previous[0], &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Blocks) != 1 || m.Blocks[0].Type != "section" || m.User.Username != "deploybot" {
+		t.Errorf("got %s", previous[0])
+	}
+	if calls := f.called("channels.history"); len(calls) != 1 || calls[0].Get("channel") != "C1" || calls[0].Get("count") != "10" {
+		t.Errorf("channels.history called with %v", calls)
+	}
+}
+
+func TestMessageBlocks(t *testing.T) {
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		return map[string]interface{}{"ok": true, "messages": []map[string]interface{}{
+			{"type": "message", "subtype": "bot_message", "ts": "1.0"},
+			{"type": "message", "subtype": "bot_message", "ts": "1.5", "blocks": testBlocks},
+		}}
+	})
+	defer f.Close()
+	h := newBlocksHub(t)
+
+	tests := []struct {
+		name   string
+		m      slack.Msg
+		method string
+		blocks int
+	}{
+		{"bot message", slack.Msg{SubType: "bot_message", BotID: "B1", Timestamp: "1.5"}, "channels.history", 1},
+		{"thread reply", slack.Msg{BotID: "B1", Timestamp: "1.5", ThreadTimestamp: "1.0"}, "channels.replies", 1},
+		{"app message without blocks", slack.Msg{BotID: "B1", Timestamp: "1.0"}, "channels.history", 0},
+		{"person", slack.Msg{User: "U1", Timestamp: "1.5"}, "", 0},
+	}
+	for _, test := range tests {
+		before := len(f.called("channels.history")) + len(f.called("channels.replies"))
+		blocks := h.messageBlocks("C1", &test.m)
+		if len(blocks) != test.blocks {
+			t.Errorf("%s: got %d blocks, want %d", test.name, len(blocks), test.blocks)
+		}
+		after := len(f.called("channels.history")) + len(f.called("channels.replies"))
+		if test.method == "" {
+			if after != before {
+				t.Errorf("%s: fetched blocks", test.name)
+			}
+			continue
+		}
+		calls := f.called(test.method)
+		if after != before+1 || len(calls) == 0 {
+			t.Errorf("%s: didn't fetch blocks with %s", test.name, test.method)
+			continue
+		}
+		form := calls[len(calls)-1]
+		if test.method == "channels.history" && (form.Get("latest") != test.m.Timestamp || form.Get("oldest") != test.m.Timestamp || form.Get("inclusive") != "1") {
+			t.Errorf("%s: channels.history called with %v", test.name, form)
+		}
+		if test.method == "channels.replies" && form.Get("thread_ts") != test.m.ThreadTimestamp {
+			t.Errorf("%s: channels.replies called with %v", test.name, form)
+		}
+	}
+
+	// visitors' own posts have no blocks
+	posted := h.posts.expect("C1", "bob", "anon|bob")
+	posted("1.5")
+	before := len(f.called("channels.history"))
+	if blocks := h.messageBlocks("C1", &slack.Msg{SubType: "bot_message", Username: "bob", Timestamp: "1.5"}); blocks != nil || len(f.called("channels.history")) != before {
+		t.Errorf("fetched blocks for a visitor's post")
+	}
+}
+
+func TestClientHandlesBlocksOnlyMessages(t *testing.T) {
+	m := &slack.Message{Msg: slack.Msg{SubType: "bot_message", Timestamp: "1.0"}}
+	if ClientHandlesMessage(m, nil) {
+		t.Errorf("handles an empty message")
+	}
+	if !ClientHandlesMessage(m, []chatBlock{{Type: "divider"}}) {
+		t.Errorf("drops a message with only blocks")
+	}
+	payload := EncodeMessageEvent(nil, testNames{}, &slack.MessageEvent{Msg: m.Msg}, []chatBlock{{Type: "divider"}})
+	if !strings.Contains(string(payload), `"blocks":[{"type":"divider"}]`) {
+		t.Errorf("encoded %s", payload)
+	}
+}
@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// channelFilter decides which slack channels are exposed to visitors at all.
+// patterns are channel names, ids or globs (eg: support-*), matched
+// case-insensitively; a leading # is ignored.
+type channelFilter struct {
+	// when non-empty, only matching channels are exposed
+	allow []string
+	// matching channels are never exposed, even if allowed
+	deny []string
+
+	// pattern -> configured mode, and the order patterns are tried in
+	modePatterns []string
+	modes        map[string]string
+}
+
+// how visitors may use a channel
+const (
+	ChannelReadWrite = "read-write"
+	ChannelReadOnly  = "read-only" // eg: an announcement feed
+	ChannelPostOnly  = "post-only" // eg: a drop box; visitors only see their own messages
+	// each visitor talks to agents in their own slack thread, and only sees that thread
+	ChannelHelpDesk = "help-desk"
+)
+
+func newChannelFilter(allow, deny []string, modes map[string]string) (*channelFilter, error) {
+	f := &channelFilter{modes: map[string]string{}}
+	var err error
+	if f.allow, err = channelPatterns(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = channelPatterns(deny); err != nil {
+		return nil, err
+	}
+	for raw, mode := range modes {
+		if mode != ChannelReadWrite && mode != ChannelReadOnly && mode != ChannelPostOnly && mode != ChannelHelpDesk {
+			return nil, fmt.Errorf("channel %s has unknown mode %s", raw, mode)
+		}
+		patterns, err := channelPatterns([]string{raw})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range patterns {
+			f.modePatterns = append(f.modePatterns, p)
+			f.modes[p] = mode
+		}
+	}
+	// plain names and ids win over globs, otherwise the order is arbitrary but stable
+	sort.Slice(f.modePatterns, func(i, j int) bool {
+		gi, gj := isGlob(f.modePatterns[i]), isGlob(f.modePatterns[j])
+		if gi != gj {
+			return gj
+		}
+		return f.modePatterns[i] < f.modePatterns[j]
+	})
+	return f, nil
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+func channelPatterns(raw []string) ([]string, error) {
+	patterns := []string{}
+	for _, p := range raw {
+		p = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(p), "#"))
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad channel pattern %s: %s", p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func matchesChannel(patterns []string, c *slack.Channel) bool {
+	id, name := strings.ToLower(c.ID), strings.ToLower(c.Name)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *channelFilter) allows(c *slack.Channel) bool {
+	if len(f.allow) != 0 && !matchesChannel(f.allow, c) {
+		return false
+	}
+	return !matchesChannel(f.deny, c)
+}
+
+// mode returns how visitors may use a channel, read-write unless configured otherwise.
+func (f *channelFilter) mode(c *slack.Channel) string {
+	for _, p := range f.modePatterns {
+		if matchesChannel([]string{p}, c) {
+			return f.modes[p]
+		}
+	}
+	return ChannelReadWrite
+}
+
+// channelVisible reports whether a channel id belongs to a known channel that
+// passes the allow and deny lists. anything else (private groups, ims, filtered
+// channels) is never sent to clients.
+func (h *Hub) channelVisible(channelID string) bool {
+	for i := range h.slackInfo.Channels {
+		if c := &h.slackInfo.Channels[i]; c.ID == channelID {
+			return h.channels.allows(c)
+		}
+	}
+	return false
+}
+
+// channelMode returns the mode a channel has for an identity (nil if the
+// client hasn't authenticated). moderators can always read and write.
+func (h *Hub) channelMode(id *identity, channelID string) string {
+	if id != nil && id.Role == RoleModerator {
+		return ChannelReadWrite
+	}
+	return h.channelModeFor(channelID)
+}
+
+// channelModeFor returns the configured mode of a channel.
+func (h *Hub) channelModeFor(channelID string) string {
+	for i := range h.slackInfo.Channels {
+		if ch := &h.slackInfo.Channels[i]; ch.ID == channelID {
+			return h.channels.mode(ch)
+		}
+	}
+	return ChannelReadWrite
+}
+
+var errBadThread = errors.New("bad thread_ts")
+
+// replyThread checks the thread an identity asked to post into, returning the one
+// to use. visitors can't see the other threads in post-only and help-desk
+// channels, so they can't reply to them either (help-desk posts go to their
+// own thread regardless).
+func (h *Hub) replyThread(id *identity, channelID, threadTs string) (string, error) {
+	switch h.channelMode(id, channelID) {
+	case ChannelPostOnly, ChannelHelpDesk:
+		return "", nil
+	}
+	if threadTs != "" && !slackTs.MatchString(threadTs) {
+		return "", errBadThread
+	}
+	return threadTs, nil
+}
+
+// canSee reports whether a client may receive a broadcast message. in post-only
+// channels visitors only see their own messages, and in help-desk channels
+// only their own thread. it must run on the hub goroutine.
+func (h *Hub) canSee(c *Client, message *channelBroadcast) bool {
+	if !h.canAccess(c.identity, message.channelID) {
+		return false
+	}
+	ownMessage := c.identity != nil && message.author != "" && c.identity.Subject == message.author
+	switch h.channelMode(c.identity, message.channelID) {
+	case ChannelPostOnly:
+		return ownMessage
+	case ChannelHelpDesk:
+		if message.threadOwner != "" {
+			return c.identity != nil && c.identity.Subject == message.threadOwner
+		}
+		// a visitor's first message can arrive before we know it started their thread
+		return ownMessage
+	default:
+		return true
+	}
+}
@@ -0,0 +1,127 @@
+package chat
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// newChannelsHub is a hub with #general (C1), #internal (C2), #feedback (C3)
+// and #support (C4), filtered and moded as given, whose exec work runs on a
+// stand-in for the hub goroutine until exec is closed. what it's asked to
+// broadcast waits for flushBroadcasts.
+func newChannelsHub(t *testing.T, disallowed []string, modes map[string]string) *Hub {
+	h := newAdminHub(t)
+	var channels []slack.Channel
+	for i, name := range []string{"general", "internal", "feedback", "support"} {
+		c := slack.Channel{}
+		c.ID, c.Name = "C"+string('1'+rune(i)), name
+		channels = append(channels, c)
+	}
+	filter, err := newChannelFilter(nil, disallowed, modes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.channels = filter
+	h.slack = slack.New("token")
+	h.slackInfo = &slack.Info{User: &slack.UserDetails{ID: "UME"}, Channels: channels}
+	h.teamInfo = &slack.TeamInfo{Icon: map[string]interface{}{"image_88": ""}}
+	h.revoked, _ = newRevocations("")
+	h.outbound, _ = newOutboundPolicy(nil, false, 0)
+	h.posts, _ = newVisitorPosts("", 0)
+	h.uploads, _ = newVisitorUploads("")
+	h.helpDesk, _ = newHelpDeskThreads("", 0)
+	h.invites, _ = newInviteRedemptions("")
+	h.presence = newAgentPresence()
+	h.subscribers = map[string]map[*Client]bool{}
+	h.broadcast = make(chan *channelBroadcast, 10)
+	return h
+}
+
+// flushBroadcasts fans out what the hub was asked to broadcast, as Run does.
+func flushBroadcasts(h *Hub) {
+	for len(h.broadcast) > 0 {
+		message := <-h.broadcast
+		done := make(chan bool)
+		h.exec <- func() {
+			h.fanOut(message)
+			close(done)
+		}
+		<-done
+	}
+}
+
+// sent empties a client's send channel.
+func sent(c *Client) []string {
+	var payloads []string
+	for len(c.send) > 0 {
+		payloads = append(payloads, string(<-c.send))
+	}
+	return payloads
+}
+
+func TestFilteredChannelNeverReachesClients(t *testing.T) {
+	f := newFakeSlack(t, nil)
+	defer f.Close()
+	h := newChannelsHub(t, []string{"internal"}, nil)
+	defer close(h.exec)
+	bob := newAdminClient(h, "anon|bob", "bob", time.Now().Add(time.Hour))
+	inbox := func(m map[string]string) {
+		h.handleInbox(&ClientMessage{Client: bob, Raw: encode(m)})
+	}
+
+	// it isn't listed
+	var welcome struct {
+		Channels []chatChannel `json:"channels"`
+	}
+	if err := json.Unmarshal(h.welcomePayload(h.identityOf(bob)), &welcome); err != nil {
+		t.Fatal(err)
+	}
+	if len(welcome.Channels) != 3 {
+		t.Errorf("welcome lists %+v, want all but internal", welcome.Channels)
+	}
+	for _, c := range welcome.Channels {
+		if c.ID == "C2" {
+			t.Errorf("welcome lists %+v", c)
+		}
+	}
+
+	// it can't be subscribed to, read or posted in, by name or id
+	for _, channel := range []string{"internal", "C2"} {
+		inbox(map[string]string{"type": "subscribe", "channel_id": channel})
+		inbox(map[string]string{"type": "history", "channel_id": channel})
+		inbox(map[string]string{"type": "thread-history", "channel_id": channel, "thread_ts": "1.1"})
+		inbox(map[string]string{"type": "message", "channel_id": channel, "text": "hi"})
+	}
+	for _, method := range []string{"channels.history", "channels.replies", "chat.postMessage"} {
+		if calls := f.called(method); len(calls) != 0 {
+			t.Errorf("called %s: %v", method, calls)
+		}
+	}
+	sent(bob)
+
+	// and what's said there isn't passed on, unlike in general
+	inbox(map[string]string{"type": "subscribe", "channel_id": "general"})
+	for _, channelID := range []string{"C2", "C1"} {
+		h.handleSlackEvent(slack.RTMEvent{Data: &slack.MessageEvent{Msg: slack.Msg{Channel: channelID, User: "U1", Text: "hi", Timestamp: "1.1"}}})
+		reaction := &slack.ReactionAddedEvent{Reaction: "tada", User: "U1"}
+		reaction.Item.Type, reaction.Item.Channel, reaction.Item.Timestamp = "message", channelID, "1.1"
+		h.handleSlackEvent(slack.RTMEvent{Data: reaction})
+	}
+	if len(h.broadcast) != 2 {
+		t.Errorf("%d broadcasts, want general's two", len(h.broadcast))
+	}
+	flushBroadcasts(h)
+	payloads := sent(bob)
+	if len(payloads) != 2 {
+		t.Errorf("bob was sent %q, want general's message and reaction", payloads)
+	}
+	for _, payload := range payloads {
+		if strings.Contains(payload, "C2") {
+			t.Errorf("bob was sent %s", payload)
+		}
+	}
+}
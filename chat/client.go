@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -52,6 +53,9 @@ func newWsUpgrader(cfg *Config) *websocket.Upgrader {
 // Client is a middleman between the websocket connection and the hub.
 type User struct {
 	Username string `json:"username"`
+	// Verified is set for identities that logged in through oidc rather than
+	// being generated anonymously.
+	Verified bool `json:"verified,omitempty"`
 }
 type Client struct {
 	hub *Hub
@@ -59,10 +63,34 @@ type Client struct {
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
+	// Buffered channel of outbound messages. it's never closed, since messages
+	// are handled (and answered) off the hub goroutine; see deliver.
 	send chan []byte
 
-	User *User
+	// closed by the hub once it's forgotten the client, see removeClient
+	gone chan struct{}
+
+	// closed to have writePump flush send and hang up, see disconnect
+	kick     chan struct{}
+	kickOnce sync.Once
+
+	// Expiry of the most recently verified token, consumed by writePump to
+	// warn the peer before their identity lapses.
+	tokenExpiry chan tokenLifetime
+
+	// who the client is, and everything else their token vouches for; User is
+	// identity.User. only the hub goroutine may touch them, see Hub.identityOf.
+	User     *User
+	identity *identity
+
+	// channel ids the client wants live messages for. only touched on the hub
+	// goroutine, see Hub.subscribers.
+	subscriptions map[string]bool
+}
+
+type tokenLifetime struct {
+	expiresAt   time.Time
+	renewWithin time.Duration
 }
 
 type ClientMessage struct {
@@ -104,20 +132,43 @@ func (c *Client) readPump() {
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
+	var expiring *time.Timer
+	var expiringC <-chan time.Time
+	var expiresAt time.Time
 	defer func() {
 		ticker.Stop()
+		if expiring != nil {
+			expiring.Stop()
+		}
 		c.conn.Close()
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
+		case lifetime := <-c.tokenExpiry:
+			// (re)arm the warning for when the token enters its renewal window,
+			// or just disarm it if the client no longer has a token
+			if expiring != nil {
+				expiring.Stop()
+			}
+			expiringC = nil
+			expiresAt = lifetime.expiresAt
+			if !expiresAt.IsZero() {
+				expiring = time.NewTimer(time.Until(expiresAt.Add(-lifetime.renewWithin)))
+				expiringC = expiring.C
+			}
+		case <-expiringC:
+			expiringC = nil
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			if err := c.conn.WriteMessage(websocket.TextMessage, EncodeTokenExpiringMessage(expiresAt)); err != nil {
 				return
 			}
-
+		case <-c.gone:
+			// The hub let go of the client.
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
@@ -139,6 +190,52 @@ func (c *Client) writePump() {
 			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
+		case <-c.kick:
+			// whatever's queued (a farewell) goes out first
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			for n := len(c.send); n > 0; n-- {
+				if c.conn.WriteMessage(websocket.TextMessage, <-c.send) != nil {
+					break
+				}
+			}
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+			return
+		}
+	}
+}
+
+// disconnect hangs up on the client once writePump has sent what's queued.
+// readPump then unregisters it as usual.
+func (c *Client) disconnect() {
+	c.kickOnce.Do(func() {
+		close(c.kick)
+	})
+}
+
+// deliver queues a message for the client from off the hub goroutine, eg: a
+// reply to one of theirs, dropping it if the hub has let go of them meanwhile.
+// the hub itself never blocks on a client, see Hub.sendWhere.
+func (c *Client) deliver(payload []byte) {
+	select {
+	case c.send <- payload:
+	case <-c.gone:
+	}
+}
+
+// setTokenExpiry schedules a token-expiring event for the given token lifetime,
+// replacing any previously scheduled one. a zero expiresAt cancels it.
+func (c *Client) setTokenExpiry(expiresAt time.Time, renewWithin time.Duration) {
+	lifetime := tokenLifetime{expiresAt: expiresAt, renewWithin: renewWithin}
+	for {
+		select {
+		case c.tokenExpiry <- lifetime:
+			return
+		default:
+			// drop the stale, unconsumed lifetime and try again
+			select {
+			case <-c.tokenExpiry:
+			default:
+			}
 		}
 	}
 }
@@ -155,6 +252,12 @@ func ServeWs(cfg *Config, hub *Hub, w http.ResponseWriter, r *http.Request) {
 		hub:  hub,
 		conn: conn,
 		send: make(chan []byte, 256),
+		gone: make(chan struct{}),
+		kick: make(chan struct{}),
+
+		tokenExpiry: make(chan tokenLifetime, 1),
+
+		subscriptions: map[string]bool{},
 	}
 	client.hub.register <- client
 
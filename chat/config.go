@@ -2,22 +2,147 @@ package chat
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	swarmed "github.com/blaskovicz/go-swarmed"
 	"github.com/jinzhu/configor"
 	"github.com/joho/godotenv"
 )
 
+const (
+	AuthFailureRegenerate = "regenerate"
+	AuthFailureReject     = "reject"
+)
+
 type Config struct {
 	Slack struct {
 		Token string `required:"true" env:"SLACK_TOKEN"` //TODO validate scopes
-		// TODO DisallowedChannels string `default:"api-testing" env:"SLACK_CHANNEL"`
+		// channels exposed to visitors, by name, id or glob (eg: [support, help-*]).
+		// when AllowedChannels is set only those are exposed; DisallowedChannels
+		// are never exposed either way.
+		AllowedChannels    []string `env:"ALLOWED_CHANNELS"`
+		DisallowedChannels []string `env:"DISALLOWED_CHANNELS"`
+		// channel (name, id or glob) -> read-write, read-only, post-only or help-desk,
+		// eg: {announcements: read-only, feedback: post-only}. moderators are exempt.
+		ChannelModes map[string]string `env:"CHANNEL_MODES"`
+
+		// what visitors' messages may do in slack. their text is escaped, so they
+		// can only ping these broadcasts (here, channel, everyone, subteam), or
+		// users with AllowUserMentions. MaxLinks of 0 allows any number of links.
+		// moderators are exempt.
+		AllowedBroadcasts []string `env:"ALLOWED_BROADCASTS"`
+		AllowUserMentions bool     `env:"ALLOW_USER_MENTIONS"`
+		MaxLinks          int      `env:"MAX_LINKS"`
+
+		// visitors see how many people are online in each channel; this names them too
+		ShowAgentNames bool `env:"SHOW_AGENT_NAMES"`
+	}
+	// OpenID Connect login (/login, /callback), enabled when Issuer is set.
+	// anonymous identities remain available either way.
+	OIDC struct {
+		Issuer       string `env:"OIDC_ISSUER"`
+		ClientID     string `env:"OIDC_CLIENT_ID"`
+		ClientSecret string `env:"OIDC_CLIENT_SECRET"`
+		RedirectURL  string `env:"OIDC_REDIRECT_URL"` // eg: https://my-slack-app.herokuapp.com/callback
+		Scopes       string `default:"openid profile" env:"OIDC_SCOPES"`
 	}
 	Server struct {
 		Domain      string `default:"localhost" env:"HEROKU_APP_DOMAIN"`
 		Port        uint   `default:"3000" env:"PORT"`
-		JWTSecret   string `required:"true" env:"JWT_SECRET"` // for hs256 hmac signing
 		LogMessages bool   `env:"LOG_MESSAGES"`
+
+		// base of links we hand out, eg: https://my-slack-app.herokuapp.com.
+		// derived from Domain and Port when unset.
+		PublicURL string `env:"PUBLIC_URL"`
+
+		// HS256 signs with JWTSecret; RS256, ES256 and EdDSA sign with JWTPrivateKey,
+		// a PEM block or @/path/to/key.pem. the private key is read from
+		// JWT_PRIVATE_KEY in LoadConfig since configor would mangle the PEM.
+		JWTAlgorithm  string `default:"HS256" env:"JWT_ALGORITHM"`
+		JWTSecret     string `env:"JWT_SECRET"`
+		JWTPrivateKey string `env:"-"`
+
+		// kid of the signing key, and older keys (kid: hs256 secret or PEM public key)
+		// which are still accepted but never signed with. tokens verified with one of
+		// those get re-signed.
+		JWTKeyID      string            `default:"default" env:"JWT_KEY_ID"`
+		JWTVerifyKeys map[string]string `env:"JWT_VERIFY_KEYS"`
+
+		// how long an identity token is valid for, and how close to expiry
+		// a token has to be before we hand out a fresh one on auth
+		JWTTTL         time.Duration `default:"168h" env:"JWT_TTL"`
+		JWTRenewWithin time.Duration `default:"24h" env:"JWT_RENEW_WITHIN"`
+
+		// what to do when a client presents a token we can't verify: "regenerate"
+		// sends them a brand new identity, "reject" leaves the socket un-authed
+		// until they ask for one. either way they're sent an auth-error.
+		AuthFailurePolicy string `default:"regenerate" env:"AUTH_FAILURE_POLICY"`
+
+		// optional json file to persist username reservations across restarts
+		UsernameStore string `env:"USERNAME_STORE"`
+
+		// optional json file to persist revoked tokens and banned usernames
+		RevocationStore string `env:"REVOCATION_STORE"`
+
+		// optional json file to persist roles granted through the admin api
+		RoleStore string `env:"ROLE_STORE"`
+
+		// optional json file to persist which thread belongs to which visitor in help-desk channels
+		HelpDeskStore string `env:"HELP_DESK_STORE"`
+		// how long a visitor's thread lasts. coming back after that, they start
+		// a new one. -1s keeps them forever.
+		HelpDeskRetention time.Duration `default:"720h" env:"HELP_DESK_RETENTION"`
+
+		// anti-spam for visitors: a burst of messages, then one per interval.
+		// trusted visitors and moderators are exempt. a negative interval (eg:
+		// -1s) disables it; 0 is taken as unset, so gets the default.
+		SendInterval time.Duration `default:"3s" env:"SEND_INTERVAL"`
+		SendBurst    int           `default:"5" env:"SEND_BURST"`
+		// the same for reactions, which are added as the portal's slack user.
+		// -1s disables it too.
+		ReactInterval time.Duration `default:"2s" env:"REACT_INTERVAL"`
+		ReactBurst    int           `default:"10" env:"REACT_BURST"`
+		// typing indicators go either way at most once per interval, per agent
+		// or visitor, and are shown until they expire
+		TypingInterval time.Duration `default:"3s" env:"TYPING_INTERVAL"`
+		TypingExpiry   time.Duration `default:"6s" env:"TYPING_EXPIRY"`
+		// how often agents' presence is polled. -1s doesn't poll, going only by
+		// presence_change, which slack mostly won't send us (see Hub.pollPresence).
+		PresenceInterval time.Duration `default:"1m" env:"PRESENCE_INTERVAL"`
+
+		// invite links scope visitors to a few channels. with InviteOnly, anonymous
+		// visitors can't read or post anywhere without one. without it, a scope
+		// only lasts as long as the visitor keeps their identity (and connection):
+		// someone who opens the page afresh is just another anonymous visitor.
+		InviteOnly bool          `env:"INVITE_ONLY"`
+		InviteTTL  time.Duration `default:"72h" env:"INVITE_TTL"`
+		// optional json file to persist who redeemed which invite, for max uses
+		InviteStore string `env:"INVITE_STORE"`
+
+		// limits on slack files visitors can fetch through /files/<id>
+		FileMaxSize int      `default:"10485760" env:"FILE_MAX_SIZE"`
+		FileTypes   []string `default:"[image/png, image/jpeg, image/gif, image/webp, application/pdf, text/plain]" env:"FILE_TYPES"`
+
+		// limits on files visitors can share into slack through /uploads. the type
+		// is sniffed from the file's contents. uploads count against SendInterval.
+		UploadMaxSize int      `default:"5242880" env:"UPLOAD_MAX_SIZE"`
+		UploadTypes   []string `default:"[image/png, image/jpeg, image/gif, image/webp, application/pdf, text/plain]" env:"UPLOAD_TYPES"`
+		// optional json file to persist who uploaded which file
+		UploadStore string `env:"UPLOAD_STORE"`
+
+		// optional json file to persist who posted visitors' messages in post-only channels
+		PostStore string `env:"POST_STORE"`
+		// how long we remember who posted them. older posts are hidden from
+		// everyone, their author included. -1s remembers them forever.
+		PostRetention time.Duration `default:"720h" env:"POST_RETENTION"`
+
+		// bearer token for the /admin/ api, which is disabled when unset
+		AdminToken string `env:"ADMIN_TOKEN"`
+
+		// names visitors can't choose for themselves (case-insensitive)
+		ReservedUsernames []string `default:"[admin, administrator, moderator, support, slackbot, here, channel, everyone]" env:"RESERVED_USERNAMES"`
 	}
 }
 
@@ -35,5 +160,20 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg.Server.JWTPrivateKey = os.Getenv("JWT_PRIVATE_KEY")
+	if p := cfg.Server.AuthFailurePolicy; p != AuthFailureRegenerate && p != AuthFailureReject {
+		return nil, fmt.Errorf("AUTH_FAILURE_POLICY must be %s or %s, got %s", AuthFailureRegenerate, AuthFailureReject, p)
+	}
+	if cfg.Server.JWTRenewWithin >= cfg.Server.JWTTTL {
+		return nil, fmt.Errorf("JWT_RENEW_WITHIN (%s) must be shorter than JWT_TTL (%s)", cfg.Server.JWTRenewWithin, cfg.Server.JWTTTL)
+	}
+	if cfg.Server.PublicURL == "" {
+		if cfg.Server.Domain == "localhost" {
+			cfg.Server.PublicURL = fmt.Sprintf("http://localhost:%d", cfg.Server.Port)
+		} else {
+			cfg.Server.PublicURL = "https://" + cfg.Server.Domain
+		}
+	}
+	cfg.Server.PublicURL = strings.TrimSuffix(cfg.Server.PublicURL, "/")
 	return &cfg, nil
 }
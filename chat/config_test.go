@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// configor fills in zero values with their defaults, so turning a limit off
+// takes a negative interval
+func TestLoadConfigLimits(t *testing.T) {
+	tests := []struct {
+		env, value string
+		limit      func(*Config) *rateLimiter
+		want       time.Duration
+		limited    bool
+	}{
+		{"SEND_INTERVAL", "", sendLimit, 3 * time.Second, true},
+		{"SEND_INTERVAL", "0", sendLimit, 3 * time.Second, true},
+		{"SEND_INTERVAL", "10s", sendLimit, 10 * time.Second, true},
+		{"SEND_INTERVAL", "-1s", sendLimit, -time.Second, false},
+		{"REACT_INTERVAL", "", reactLimit, 2 * time.Second, true},
+		{"REACT_INTERVAL", "0", reactLimit, 2 * time.Second, true},
+		{"REACT_INTERVAL", "-1s", reactLimit, -time.Second, false},
+	}
+	for _, test := range tests {
+		l := test.limit(loadConfigWith(t, test.env, test.value))
+		if limited := l != nil; limited != test.limited {
+			t.Errorf("%s=%q: limited = %v, want %v", test.env, test.value, limited, test.limited)
+		} else if limited && l.interval != test.want {
+			t.Errorf("%s=%q: interval = %s, want %s", test.env, test.value, l.interval, test.want)
+		}
+	}
+}
+
+func TestLoadConfigPresenceInterval(t *testing.T) {
+	for value, want := range map[string]time.Duration{"": time.Minute, "0": time.Minute, "-1s": -time.Second} {
+		if got := loadConfigWith(t, "PRESENCE_INTERVAL", value).Server.PresenceInterval; got != want {
+			t.Errorf("PRESENCE_INTERVAL=%q: got %s, want %s", value, got, want)
+		}
+	}
+
+	// which doesn't poll at all
+	h := &Hub{}
+	polled := make(chan bool)
+	go func() {
+		h.pollPresence(-time.Second)
+		close(polled)
+	}()
+	select {
+	case <-polled:
+	case <-time.After(time.Second):
+		t.Error("polling with a negative interval")
+	}
+}
+
+// loadConfigWith loads the config with env set to value, and the settings it requires.
+func loadConfigWith(t *testing.T, env, value string) *Config {
+	if os.Getenv("SLACK_TOKEN") == "" {
+		os.Setenv("SLACK_TOKEN", "token")
+		defer os.Unsetenv("SLACK_TOKEN")
+	}
+	os.Setenv(env, value)
+	defer os.Unsetenv(env)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("%s=%q: %s", env, value, err)
+	}
+	return cfg
+}
+
+func sendLimit(cfg *Config) *rateLimiter {
+	return newRateLimiter(cfg.Server.SendInterval, cfg.Server.SendBurst)
+}
+
+func reactLimit(cfg *Config) *rateLimiter {
+	return newRateLimiter(cfg.Server.ReactInterval, cfg.Server.ReactBurst)
+}
@@ -0,0 +1,93 @@
+//go:build go1.13
+// +build go1.13
+
+package chat
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// signingMethodEdDSA signs tokens with ed25519 (rfc 8037), which the vendored
+// jwt-go predates.
+type signingMethodEdDSA struct{}
+
+var edDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(algEdDSA, func() jwt.SigningMethod { return edDSA })
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return algEdDSA
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok || len(pub) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok || len(priv) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// edDSASigningKey loads a PKCS #8 ed25519 private key, eg: from openssl genpkey -algorithm ed25519.
+func edDSASigningKey(id, material string) (*tokenKey, error) {
+	block, _ := pem.Decode([]byte(material))
+	if block == nil {
+		return nil, fmt.Errorf("%s signing requires an ed25519 JWT_PRIVATE_KEY", algEdDSA)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s signing requires an ed25519 JWT_PRIVATE_KEY: %s", algEdDSA, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s signing requires an ed25519 JWT_PRIVATE_KEY", algEdDSA)
+	}
+	return &tokenKey{id: id, method: edDSA, signKey: key, verifyKey: key.Public()}, nil
+}
+
+// edDSAVerifyKey loads a PEM ed25519 public key, if that's what material is.
+func edDSAVerifyKey(id, material string) (*tokenKey, bool) {
+	block, _ := pem.Decode([]byte(material))
+	if block == nil {
+		return nil, false
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, false
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, false
+	}
+	return &tokenKey{id: id, method: edDSA, verifyKey: key}, true
+}
+
+// edDSAJWK publishes an ed25519 public key as an octet key pair (rfc 8037).
+func edDSAJWK(id string, key *tokenKey) (jwk, bool) {
+	pub, ok := key.verifyKey.(ed25519.PublicKey)
+	if !ok {
+		return jwk{}, false
+	}
+	return jwk{Kty: "OKP", Kid: id, Alg: algEdDSA, Use: "sig", Crv: "Ed25519", X: jwt.EncodeSegment(pub)}, true
+}
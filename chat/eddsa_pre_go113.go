@@ -0,0 +1,20 @@
+//go:build !go1.13
+// +build !go1.13
+
+package chat
+
+import "fmt"
+
+// crypto/ed25519 arrived in go1.13; older builds can't sign or verify EdDSA tokens.
+
+func edDSASigningKey(id, material string) (*tokenKey, error) {
+	return nil, fmt.Errorf("%s signing requires building with go1.13 or newer", algEdDSA)
+}
+
+func edDSAVerifyKey(id, material string) (*tokenKey, bool) {
+	return nil, false
+}
+
+func edDSAJWK(id string, key *tokenKey) (jwk, bool) {
+	return jwk{}, false
+}
@@ -0,0 +1,54 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+// fakeSlack stands in for slack's web api, recording each call's form and
+// answering with whatever respond returns for that method. Close it when done.
+type fakeSlack struct {
+	*httptest.Server
+	mu       sync.Mutex
+	calls    map[string][]url.Values
+	previous string
+}
+
+func newFakeSlack(t *testing.T, respond func(method string, form url.Values) map[string]interface{}) *fakeSlack {
+	f := &fakeSlack{calls: map[string][]url.Values{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("bad request to fake slack: %s", err)
+		}
+		method := r.URL.Path[1:]
+		f.mu.Lock()
+		f.calls[method] = append(f.calls[method], r.Form)
+		f.mu.Unlock()
+		resp := map[string]interface{}{"ok": true}
+		if respond != nil {
+			if custom := respond(method, r.Form); custom != nil {
+				resp = custom
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	f.previous, slack.SLACK_API = slack.SLACK_API, f.URL+"/"
+	return f
+}
+
+func (f *fakeSlack) Close() {
+	slack.SLACK_API = f.previous
+	f.Server.Close()
+}
+
+func (f *fakeSlack) called(method string) []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
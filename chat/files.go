@@ -0,0 +1,240 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+var slackFileID = regexp.MustCompile(`^F[A-Z0-9]+$`)
+
+// fetching files from slack shouldn't tie up a request forever
+var fileClient = &http.Client{Timeout: 60 * time.Second}
+
+// fileProxyURL is where the web client can fetch a slack file from us.
+func fileProxyURL(fileID string) string {
+	return "/files/" + fileID
+}
+
+// fileTypeAllowed checks a mimetype against globs like image/*.
+func fileTypeAllowed(allowed []string, mimetype string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// identityFromRequest verifies the bearer token on an http request.
+func (h *Hub) identityFromRequest(r *http.Request) (*identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, fmt.Errorf("bearer token required")
+	}
+	id, _, err := verifySignedJWT(h.keys, strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	if h.revoked.isRevoked(id) {
+		return nil, fmt.Errorf("identity was revoked")
+	}
+	return id, nil
+}
+
+// sharedFile is a file as files.info describes it, with where it was shared.
+// the vendored slack client doesn't decode shares.
+type sharedFile struct {
+	slack.File
+	Shares struct {
+		Public  map[string][]fileShare `json:"public"`
+		Private map[string][]fileShare `json:"private"`
+	} `json:"shares"`
+}
+type fileShare struct {
+	Ts       string `json:"ts"`
+	ThreadTs string `json:"thread_ts"`
+}
+
+// inThread reports whether a file was shared into a thread of a channel.
+func (f *sharedFile) inThread(channelID, threadTs string) bool {
+	for _, shares := range [][]fileShare{f.Shares.Public[channelID], f.Shares.Private[channelID]} {
+		for _, share := range shares {
+			if share.ThreadTs == threadTs {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fileInfo looks up a file with files.info.
+func fileInfo(token, fileID string) (*sharedFile, error) {
+	var result struct {
+		File *sharedFile `json:"file"`
+	}
+	if err := callSlack("files.info", url.Values{"token": {token}, "file": {fileID}}, &result); err != nil {
+		return nil, err
+	}
+	if result.File == nil {
+		return nil, fmt.Errorf("files.info sent no file")
+	}
+	return result.File, nil
+}
+
+// canSeeFile reports whether an identity may see a file shared in slack: it
+// has to be in a channel they can read in full, be one they uploaded, or be
+// shared into their own help-desk thread.
+func (h *Hub) canSeeFile(id *identity, f *sharedFile) bool {
+	by := h.uploads.uploader(f.ID)
+	for _, channelID := range f.Channels {
+		if !h.channelVisible(channelID) || !h.canAccess(id, channelID) {
+			continue
+		}
+		if by != nil && by.Subject == id.Subject {
+			return true
+		}
+		// files in post-only and help-desk channels may be someone else's
+		switch h.channelMode(id, channelID) {
+		case ChannelReadWrite, ChannelReadOnly:
+			return true
+		case ChannelHelpDesk:
+			if threadTs := h.helpDesk.thread(channelID, id.Subject); threadTs != "" && f.inThread(channelID, threadTs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ServeFile proxies a slack-hosted file (GET /files/<id>) to visitors allowed
+// to see it, since slack's private urls need our workspace token. visitors
+// authenticate with their identity token as a bearer token.
+func ServeFile(cfg *Config, hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if hub.slackInfo == nil {
+		http.Error(w, "not connected to slack yet", http.StatusServiceUnavailable)
+		return
+	}
+	fileID := strings.TrimPrefix(r.URL.Path, "/files/")
+	if !slackFileID.MatchString(fileID) {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := hub.identityFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	f, err := fileInfo(cfg.Slack.Token, fileID)
+	if err != nil {
+		log.Printf("error: couldn't look up file %s - %s\n", fileID, err)
+		http.NotFound(w, r)
+		return
+	}
+	// don't tell visitors about files they can't see
+	if !hub.canSeeFile(id, f) {
+		log.Printf("warn: refusing file %s to %s, not in a channel they can see\n", fileID, id.User.Username)
+		http.NotFound(w, r)
+		return
+	}
+	if f.Size > cfg.Server.FileMaxSize {
+		http.Error(w, "file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !fileTypeAllowed(cfg.Server.FileTypes, f.Mimetype) {
+		http.Error(w, "file type not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// only ever send our token to slack
+	source := f.URLPrivateDownload
+	if source == "" {
+		source = f.URLPrivate
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Host, ".slack.com") {
+		log.Printf("error: file %s has unexpected url %s\n", fileID, source)
+		http.Error(w, "file unavailable", http.StatusBadGateway)
+		return
+	}
+	req, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		http.Error(w, "file unavailable", http.StatusBadGateway)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Slack.Token)
+	resp, err := fileClient.Do(req)
+	if err != nil {
+		log.Printf("error: couldn't fetch file %s - %s\n", fileID, err)
+		http.Error(w, "file unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("error: couldn't fetch file %s - slack responded %s\n", fileID, resp.Status)
+		http.Error(w, "file unavailable", http.StatusBadGateway)
+		return
+	}
+	// slack's idea of the size could be stale, so check what actually comes
+	// back before answering rather than send a truncated file
+	if resp.ContentLength > int64(cfg.Server.FileMaxSize) {
+		http.Error(w, "file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(cfg.Server.FileMaxSize)+1))
+	if err != nil {
+		log.Printf("error: failed fetching file %s - %s\n", fileID, err)
+		http.Error(w, "file unavailable", http.StatusBadGateway)
+		return
+	}
+	if len(data) > cfg.Server.FileMaxSize {
+		http.Error(w, "file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+		log.Printf("error: file %s was cut short - got %d of %d bytes\n", fileID, len(data), resp.ContentLength)
+		http.Error(w, "file unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// the response depends on who's asking, so it must never land in a shared cache.
+	// it's served sandboxed so that html or svg can't run as us.
+	disposition := "attachment"
+	if strings.HasPrefix(f.Mimetype, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", f.Mimetype)
+	if cd := mime.FormatMediaType(disposition, map[string]string{"filename": f.Name}); cd != "" {
+		w.Header().Set("Content-Disposition", cd)
+	} else {
+		// eg: a name that can't be represented
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("Vary", "Authorization")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	if _, err := w.Write(data); err != nil {
+		log.Printf("error: failed sending file %s - %s\n", fileID, err)
+	}
+}
@@ -0,0 +1,133 @@
+package chat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// toServer sends requests for slack's file hosts to a test server instead.
+type toServer struct {
+	server *httptest.Server
+}
+
+func (t toServer) RoundTrip(r *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(r.URL.Host, ".slack.com") {
+		u, _ := url.Parse(t.server.URL)
+		r2 := *r
+		r2.URL = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: r.URL.Path}
+		r = &r2
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestServeFile(t *testing.T) {
+	// files.slack.com/<name> serves F<NAME>, with a content-length unless it's chunked
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Header().Set("Content-Length", "5")
+			fmt.Fprint(w, "hello")
+		case "/large":
+			w.Header().Set("Content-Length", "20")
+			fmt.Fprint(w, strings.Repeat("x", 20))
+		case "/chunked":
+			fmt.Fprint(w, strings.Repeat("x", 10))
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, strings.Repeat("x", 10))
+		case "/short":
+			w.Header().Set("Content-Length", "10")
+			fmt.Fprint(w, "hello")
+		}
+	}))
+	defer files.Close()
+	previous := fileClient
+	fileClient = &http.Client{Transport: toServer{files}}
+	defer func() { fileClient = previous }()
+
+	// F<name> is in #general, or in a help-desk thread for FTHREAD<ts>
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		id := form.Get("file")
+		file := map[string]interface{}{"id": id, "name": "a.png", "mimetype": "image/png", "size": 5, "channels": []string{"C1"}}
+		if strings.HasPrefix(id, "FTHREAD") {
+			file["channels"] = []string{"C2"}
+			file["shares"] = map[string]interface{}{"public": map[string]interface{}{
+				"C2": []map[string]string{{"ts": "2.0", "thread_ts": strings.TrimPrefix(id, "FTHREAD") + ".0"}},
+			}}
+			id = "FOK"
+		}
+		file["url_private_download"] = "https://files.slack.com/" + strings.ToLower(id[1:])
+		return map[string]interface{}{"ok": true, "file": file}
+	})
+	defer f.Close()
+
+	cfg := &Config{}
+	cfg.Server.JWTKeyID, cfg.Server.JWTAlgorithm, cfg.Server.JWTSecret = "k1", "HS256", "secret"
+	cfg.Server.FileMaxSize, cfg.Server.FileTypes = 10, []string{"image/*"}
+	keys, err := newKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	general, helpDesk := slack.Channel{}, slack.Channel{}
+	general.ID, general.Name = "C1", "general"
+	helpDesk.ID, helpDesk.Name = "C2", "help"
+	channels, err := newChannelFilter(nil, nil, map[string]string{"help": ChannelHelpDesk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _ := newRevocations("")
+	uploads, _ := newVisitorUploads("")
+	threads, _ := newHelpDeskThreads("", 0)
+	threads.start("C2", "anon|bob", "1.0")
+	h := &Hub{
+		slack:     slack.New("token"),
+		slackInfo: &slack.Info{User: &slack.UserDetails{ID: "UME"}, Channels: []slack.Channel{general, helpDesk}},
+		channels:  channels,
+		keys:      keys,
+		revoked:   revoked,
+		uploads:   uploads,
+		helpDesk:  threads,
+	}
+	user := &User{Username: "bob"}
+	_, token, err := signUserJWT(keys, &identity{Subject: "anon|bob", User: user, Role: RoleVisitor}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fileID string
+		status int
+	}{
+		{"FOK", http.StatusOK},
+		{"FLARGE", http.StatusRequestEntityTooLarge},
+		{"FCHUNKED", http.StatusRequestEntityTooLarge},
+		{"FSHORT", http.StatusBadGateway},
+		// shared by an agent into bob's help-desk thread, or someone else's
+		{"FTHREAD1", http.StatusOK},
+		{"FTHREAD3", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/files/"+test.fileID, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		ServeFile(cfg, h, w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.fileID, w.Code, test.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		body, _ := ioutil.ReadAll(w.Body)
+		if string(body) != "hello" || w.Header().Get("Content-Length") != "5" {
+			t.Errorf("%s: got %q (content-length %s)", test.fileID, body, w.Header().Get("Content-Length"))
+		}
+	}
+}
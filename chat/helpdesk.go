@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// helpDeskThreads remembers which slack thread holds each visitor's conversation
+// in a help-desk channel. visitors are keyed by subject, so a name change keeps
+// the thread. threads are forgotten once they were started longer ago than
+// retention (unless it's <= 0), so a visitor coming back after that starts a
+// new one. it's optionally mirrored to a json file.
+type helpDeskThreads struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+
+	// channel id -> subject -> thread ts
+	bySubject map[string]map[string]string
+	// channel id + "/" + thread ts -> subject
+	byThread map[string]string
+
+	// serializes visitors starting new threads, so one visitor can't start two
+	starting sync.Mutex
+}
+
+func newHelpDeskThreads(path string, retention time.Duration) (*helpDeskThreads, error) {
+	t := &helpDeskThreads{path: path, retention: retention, bySubject: map[string]map[string]string{}, byThread: map[string]string{}}
+	if path == "" {
+		return t, nil
+	}
+	if err := loadJSONFile(path, &t.bySubject); err != nil {
+		return nil, err
+	}
+	if t.bySubject == nil {
+		t.bySubject = map[string]map[string]string{}
+	}
+	count := 0
+	for channelID, threads := range t.bySubject {
+		for subject, ts := range threads {
+			t.byThread[channelID+"/"+ts] = subject
+			count++
+		}
+	}
+	log.Printf("loaded %d help-desk threads from %s\n", count, path)
+	return t, nil
+}
+
+// thread returns the ts of a visitor's thread in a channel, or "" if they haven't started one.
+func (t *helpDeskThreads) thread(channelID, subject string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ts := t.bySubject[channelID][subject]; !t.expired(ts) {
+		return ts
+	}
+	return ""
+}
+
+// owner returns the subject whose thread starts at ts, or "" if it isn't a visitor's thread.
+func (t *helpDeskThreads) owner(channelID, ts string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expired(ts) {
+		return ""
+	}
+	return t.byThread[channelID+"/"+ts]
+}
+
+func (t *helpDeskThreads) expired(ts string) bool {
+	return t.retention > 0 && slackTsTime(ts).Before(time.Now().Add(-t.retention))
+}
+
+func (t *helpDeskThreads) start(channelID, subject, ts string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	threads, ok := t.bySubject[channelID]
+	if !ok {
+		threads = map[string]string{}
+		t.bySubject[channelID] = threads
+	}
+	threads[subject] = ts
+	t.byThread[channelID+"/"+ts] = subject
+	t.persist()
+}
+
+// persist forgets threads past retention and writes the rest out. callers hold mu.
+func (t *helpDeskThreads) persist() {
+	for channelID, threads := range t.bySubject {
+		for subject, ts := range threads {
+			if t.expired(ts) {
+				delete(threads, subject)
+			}
+		}
+		if len(threads) == 0 {
+			delete(t.bySubject, channelID)
+		}
+	}
+	for key := range t.byThread {
+		if t.expired(key[strings.LastIndex(key, "/")+1:]) {
+			delete(t.byThread, key)
+		}
+	}
+	if t.path == "" {
+		return
+	}
+	if err := saveJSONFile(t.path, t.bySubject); err != nil {
+		log.Printf("error: couldn't save help-desk threads to %s - %s\n", t.path, err)
+	}
+}
+
+// postHelpDeskMessage sends a visitor's message into their own thread in a
+// help-desk channel, starting the thread (tagged with who they are, for agents)
+// with their first message. it returns the thread's ts.
+func (h *Hub) postHelpDeskMessage(id *identity, channelID, text string) (string, error) {
+	params := visitorPostParams(id.User.Username, "")
+	subject := id.Subject
+	if ts := h.helpDesk.thread(channelID, subject); ts != "" {
+		params.ThreadTimestamp = ts
+		_, _, err := h.slack.PostMessage(channelID, text, params)
+		return ts, err
+	}
+
+	h.helpDesk.starting.Lock()
+	defer h.helpDesk.starting.Unlock()
+	// someone else may have started it while we waited
+	if ts := h.helpDesk.thread(channelID, subject); ts != "" {
+		params.ThreadTimestamp = ts
+		_, _, err := h.slack.PostMessage(channelID, text, params)
+		return ts, err
+	}
+	params.Attachments = []slack.Attachment{{
+		Fallback: fmt.Sprintf("help-desk visitor %s", id.User.Username),
+		Footer:   fmt.Sprintf("help-desk visitor %s (%s) - reply in thread to answer privately", id.User.Username, subject),
+	}}
+	_, ts, err := h.slack.PostMessage(channelID, text, params)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("started help-desk thread %s in %s for %s\n", ts, channelID, id.User.Username)
+	h.helpDesk.start(channelID, subject, ts)
+	return ts, nil
+}
+
+// threadMessages fetches a thread's parent and replies, oldest first, keeping
+// at most limit of the newest. the vendored slack client predates
+// conversations.replies, but channels.replies covers the public channels we expose.
+func (h *Hub) threadMessages(channelID, threadTs string, limit int) [][]byte {
+	thread := [][]byte{}
+	messages, err := h.threadReplies(channelID, threadTs)
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		return thread
+	}
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	for i := range messages {
+		m, blocks := messages[i].Message, newChatBlocks(messages[i].Blocks, h)
+		h.attributeUpload(channelID, &m.Msg)
+		if !ClientHandlesMessage(&m, blocks) {
+			continue
+		}
+		m.Channel = channelID // channel is unset in slack response, but our client expects it
+		thread = append(thread, EncodeMessageEvent(h.slack, h, (*slack.MessageEvent)(&m), blocks))
+	}
+	return thread
+}
@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+func TestPostHelpDeskMessageParams(t *testing.T) {
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		return map[string]interface{}{"ok": true, "channel": form.Get("channel"), "ts": "1.0001"}
+	})
+	defer f.Close()
+	threads, _ := newHelpDeskThreads("", 0)
+	h := &Hub{slack: slack.New("token"), helpDesk: threads}
+	id := &identity{Subject: "sub-1", User: &User{Username: "bob"}}
+
+	// sanitized text goes out as is, and is formatted by slack
+	text := "*hi* &lt;b&gt; <https://example.com|a link>"
+	for i, wantThread := range []string{"", "1.0001"} {
+		ts, err := h.postHelpDeskMessage(id, "C1", text)
+		if err != nil || ts != "1.0001" {
+			t.Fatalf("post %d: got %q, %v", i, ts, err)
+		}
+		posts := f.called("chat.postMessage")
+		if len(posts) != i+1 {
+			t.Fatalf("post %d: %d calls to chat.postMessage", i, len(posts))
+		}
+		form := posts[i]
+		for key, want := range map[string]string{
+			"channel":   "C1",
+			"text":      text,
+			"username":  "bob",
+			"icon_url":  "https://www.gravatar.com/avatar/9f9d51bc70ef21ca5c14f307980a29d8?d=retro",
+			"thread_ts": wantThread,
+			"mrkdwn":    "",
+		} {
+			if got := form.Get(key); got != want {
+				t.Errorf("post %d: %s = %q, want %q", i, key, got, want)
+			}
+		}
+	}
+}
+
+func TestHelpDeskThreadsRetention(t *testing.T) {
+	ts := func(age time.Duration) string {
+		return fmt.Sprintf("%d.000100", time.Now().Add(-age).Unix())
+	}
+	old, recent := ts(2*time.Hour), ts(time.Minute)
+
+	threads, _ := newHelpDeskThreads("", time.Hour)
+	threads.start("C1", "anon|bob", old)
+	if thread, owner := threads.thread("C1", "anon|bob"), threads.owner("C1", old); thread != "" || owner != "" {
+		t.Errorf("thread older than retention: bob's is %q, it's %q's", thread, owner)
+	}
+	// bob comes back and starts another, and the old one is forgotten
+	threads.start("C1", "anon|bob", recent)
+	if thread, owner := threads.thread("C1", "anon|bob"), threads.owner("C1", recent); thread != recent || owner != "anon|bob" {
+		t.Errorf("recent thread: bob's is %q, it's %q's", thread, owner)
+	}
+	threads.start("C2", "anon|carol", old)
+	threads.start("C1", "anon|dave", ts(2*time.Minute))
+	if len(threads.byThread) != 2 || len(threads.bySubject) != 1 || len(threads.bySubject["C1"]) != 2 {
+		t.Errorf("remembering %v and %v, want only the recent threads", threads.bySubject, threads.byThread)
+	}
+
+	forever, _ := newHelpDeskThreads("", 0)
+	forever.start("C1", "anon|bob", old)
+	if thread := forever.thread("C1", "anon|bob"); thread != old {
+		t.Errorf("without retention, bob's thread is %q", thread)
+	}
+}
@@ -2,8 +2,15 @@ package chat
 
 import (
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/nlopes/slack"
 )
@@ -16,7 +23,10 @@ type Hub struct {
 	clientCount int
 
 	// Inbound messages from slack to the clients.
-	broadcast chan []byte
+	broadcast chan *channelBroadcast
+
+	// channel id -> clients subscribed to its live messages
+	subscribers map[string]map[*Client]bool
 
 	// Inbound messages from clients to slack
 	inbox chan *ClientMessage
@@ -33,29 +43,164 @@ type Hub struct {
 	// log slack inbound and outbound messages
 	logMessages bool
 
-	// for jwt hs256 hmac signing
-	jwtSecret []byte
+	// for jwt signing and verification
+	keys *keyring
+
+	// revoked tokens and banned identities
+	revoked *revocations
+
+	// Work that needs the registered clients, run on the hub goroutine.
+	exec chan func()
+
+	// roles granted by admins, and the anti-spam limit for plain visitors
+	roles      *roleGrants
+	sendLimit  *rateLimiter
+	reactLimit *rateLimiter
+
+	// typing indicators: agents' are debounced per channel and user, visitors'
+	// limited per identity
+	agentTyping  *rateLimiter
+	typingLimit  *rateLimiter
+	typingExpiry time.Duration
+
+	// usernames held by live identities, and ones visitors can never pick
+	names         *usernameRegistry
+	reservedNames []string
+
+	// channels visitors may see at all
+	channels *channelFilter
+
+	// agents online in each channel, and whether visitors see their names
+	presence         *agentPresence
+	showAgentNames   bool
+	presenceInterval time.Duration
+
+	// what visitors' messages may do in slack
+	outbound *outboundPolicy
+
+	// each visitor's thread in help-desk channels
+	helpDesk *helpDeskThreads
+
+	// who uploaded the files visitors shared through us
+	uploads *visitorUploads
+
+	// who posted visitors' messages in post-only channels
+	posts *visitorPosts
+
+	// channel-scoped invite links, and who has redeemed them
+	invites    *inviteRedemptions
+	inviteOnly bool
+	inviteTTL  time.Duration
+	publicURL  string
+
+	// optional openid connect login, nil when disabled
+	oidc *oidcProvider
+
+	// regenerate or reject identities that fail verification
+	authFailurePolicy string
+
+	// identity token lifetime and sliding renewal window
+	tokenTTL         time.Duration
+	tokenRenewWithin time.Duration
 
 	// Slack RTM Client
 	slack *slack.Client
+	// its token, for the calls we make ourselves (see callSlack)
+	slackToken string
+	// its connection, once we're running, for sending typing
+	rtm *slack.RTM
 
 	// information pushed during welcome
 	slackInfo   *slack.Info
 	teamInfo    *slack.TeamInfo
 	customEmoji map[string]string
+	// members' display names by id, which our slack client doesn't decode
+	displayNames map[string]string
 }
 
 func NewHub(cfg *Config) (*Hub, error) {
+	channels, err := newChannelFilter(cfg.Slack.AllowedChannels, cfg.Slack.DisallowedChannels, cfg.Slack.ChannelModes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel config: %s", err)
+	}
+	outbound, err := newOutboundPolicy(cfg.Slack.AllowedBroadcasts, cfg.Slack.AllowUserMentions, cfg.Slack.MaxLinks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mention config: %s", err)
+	}
+	keys, err := newKeyring(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt keys: %s", err)
+	}
+	names, err := newUsernameRegistry(cfg.Server.UsernameStore)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load username store: %s", err)
+	}
+	revoked, err := newRevocations(cfg.Server.RevocationStore)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load revocation store: %s", err)
+	}
+	roles, err := newRoleGrants(cfg.Server.RoleStore)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load role store: %s", err)
+	}
+	helpDesk, err := newHelpDeskThreads(cfg.Server.HelpDeskStore, cfg.Server.HelpDeskRetention)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load help-desk store: %s", err)
+	}
+	uploads, err := newVisitorUploads(cfg.Server.UploadStore)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load upload store: %s", err)
+	}
+	posts, err := newVisitorPosts(cfg.Server.PostStore, cfg.Server.PostRetention)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load post store: %s", err)
+	}
+	invites, err := newInviteRedemptions(cfg.Server.InviteStore)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load invite store: %s", err)
+	}
+	oidc, err := newOIDCProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oidc config: %s", err)
+	}
 	h := &Hub{
-		logMessages:    cfg.Server.LogMessages,
-		jwtSecret:      []byte(cfg.Server.JWTSecret),
-		slack:          slack.New(cfg.Slack.Token),
-		inbox:          make(chan *ClientMessage),
-		broadcast:      make(chan []byte),
-		register:       make(chan *Client),
-		unregister:     make(chan *Client),
-		clients:        make(map[*Client]bool),
-		slackConnected: make(chan interface{}),
+		logMessages:       cfg.Server.LogMessages,
+		channels:          channels,
+		presence:          newAgentPresence(),
+		showAgentNames:    cfg.Slack.ShowAgentNames,
+		presenceInterval:  cfg.Server.PresenceInterval,
+		outbound:          outbound,
+		helpDesk:          helpDesk,
+		uploads:           uploads,
+		posts:             posts,
+		keys:              keys,
+		names:             names,
+		revoked:           revoked,
+		exec:              make(chan func()),
+		roles:             roles,
+		sendLimit:         newRateLimiter(cfg.Server.SendInterval, cfg.Server.SendBurst),
+		reactLimit:        newRateLimiter(cfg.Server.ReactInterval, cfg.Server.ReactBurst),
+		agentTyping:       newRateLimiter(cfg.Server.TypingInterval, 1),
+		typingLimit:       newRateLimiter(cfg.Server.TypingInterval, 1),
+		typingExpiry:      cfg.Server.TypingExpiry,
+		reservedNames:     cfg.Server.ReservedUsernames,
+		invites:           invites,
+		inviteOnly:        cfg.Server.InviteOnly,
+		inviteTTL:         cfg.Server.InviteTTL,
+		publicURL:         cfg.Server.PublicURL,
+		authFailurePolicy: cfg.Server.AuthFailurePolicy,
+		oidc:              oidc,
+		tokenTTL:          cfg.Server.JWTTTL,
+		tokenRenewWithin:  cfg.Server.JWTRenewWithin,
+		slack:             slack.New(cfg.Slack.Token),
+		slackToken:        cfg.Slack.Token,
+		inbox:             make(chan *ClientMessage),
+		broadcast:         make(chan *channelBroadcast),
+		register:          make(chan *Client),
+		unregister:        make(chan *Client),
+		clients:           make(map[*Client]bool),
+		subscribers:       make(map[string]map[*Client]bool),
+		slackConnected:    make(chan interface{}),
 	}
 	//logger := log.New(os.Stdout, "slack-bot: ", log.Lshortfile|log.LstdFlags)
 	//logger.SetLevel()
@@ -75,10 +220,37 @@ func (h *Hub) loadSlackInfo() {
 	if err != nil {
 		log.Printf("error: couldn't load extra team info: %s\n", err)
 	}
+	h.displayNames, err = h.memberDisplayNames()
+	if err != nil {
+		log.Printf("error: couldn't load display names: %s\n", err)
+	}
+}
+
+// memberDisplayNames is GetUsers, keeping profiles' display names.
+func (h *Hub) memberDisplayNames() (map[string]string, error) {
+	var result struct {
+		Members []struct {
+			ID      string `json:"id"`
+			Profile struct {
+				DisplayName string `json:"display_name"`
+			} `json:"profile"`
+		} `json:"members"`
+	}
+	if err := callSlack("users.list", url.Values{"token": {h.slackToken}}, &result); err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(result.Members))
+	for _, m := range result.Members {
+		if m.Profile.DisplayName != "" {
+			names[m.ID] = m.Profile.DisplayName
+		}
+	}
+	return names, nil
 }
 
 func (h *Hub) runSlack() {
 	slackSock := h.slack.NewRTM()
+	h.rtm = slackSock
 	go slackSock.ManageConnection()
 	for slackEvent := range slackSock.IncomingEvents {
 		//log.Println("slack event.")
@@ -90,6 +262,7 @@ func (h *Hub) Run() {
 	h.loadSlackInfo()
 	go h.runSlack()
 	<-h.slackConnected
+	go h.pollPresence(h.presenceInterval)
 
 	for {
 		select {
@@ -97,49 +270,123 @@ func (h *Hub) Run() {
 			h.clients[client] = true
 			h.clientCount++
 			log.Printf("client registered (count=%d)\n", h.clientCount)
+			// they haven't authenticated yet
 			go func() {
-				client.send <- h.welcomePayload(client)
+				client.deliver(h.welcomePayload(nil))
 			}()
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				h.clientCount--
+				h.removeClient(client)
 				log.Printf("client unregistered (count=%d)\n", h.clientCount)
-				delete(h.clients, client)
-				close(client.send)
 			}
+		case f := <-h.exec:
+			f()
 		case message := <-h.inbox:
 			go func() {
 				h.handleInbox(message)
 			}()
 		case message := <-h.broadcast:
-			// mux message to all clients
-			log.Printf("flushing message broadcast to all clients (count=%d)\n", h.clientCount)
-			go func() {
-				for client := range h.clients {
-					select {
-					case client.send <- message:
-					default:
-						h.clientCount--
-						close(client.send)
-						delete(h.clients, client)
-					}
-				}
-			}()
+			h.fanOut(message)
+		}
+	}
+}
+
+// fanOut muxes a broadcast to the channel's subscribers that may see it,
+// dropping any too backed up to take it. it must run on the hub goroutine.
+func (h *Hub) fanOut(message *channelBroadcast) {
+	subscribers := h.subscribers[message.channelID]
+	log.Printf("flushing message broadcast to %s subscribers (count=%d)\n", message.channelID, len(subscribers))
+	for client := range subscribers {
+		if !h.canSee(client, message) {
+			continue
+		}
+		select {
+		case client.send <- message.payload:
+		default:
+			h.removeClient(client)
+		}
+	}
+}
+
+// channelBroadcast is a message for every client that may see channelID.
+type channelBroadcast struct {
+	channelID string
+	// subject of the visitor who posted it, if any, for post-only channels
+	author string
+	// subject of the visitor whose thread it's in, for help-desk channels
+	threadOwner string
+	payload     []byte
+}
+
+// routeBroadcast works out who a message's payload is for: its author, for
+// post-only channels, and the visitor whose thread it's in, for help-desk channels.
+func (h *Hub) routeBroadcast(channelID string, m *slack.Message, payload []byte) *channelBroadcast {
+	message := &channelBroadcast{channelID: channelID, author: h.postedBy(channelID, m), payload: payload}
+	if h.channelModeFor(channelID) == ChannelHelpDesk {
+		// replies carry the thread's ts, the visitor's first message is the thread
+		threadTs := m.ThreadTimestamp
+		if threadTs == "" {
+			threadTs = m.Timestamp
 		}
+		message.threadOwner = h.helpDesk.owner(channelID, threadTs)
 	}
+	return message
 }
 
 // check if we're using a valid slack channel
-// from either name or ID and then use the canonical ID
+// from either name or ID and then use the canonical ID.
+// channels filtered out by config are never resolved.
 func (h *Hub) resolveSlackChannel(idOrName string) (id string) {
-	for _, c := range h.slackInfo.Channels {
-		if c.Name == idOrName || c.ID == idOrName {
+	for i := range h.slackInfo.Channels {
+		c := &h.slackInfo.Channels[i]
+		if (c.Name == idOrName || c.ID == idOrName) && h.channels.allows(c) {
 			return c.ID
 		}
 	}
 	return ""
 }
 
+// slackUser finds a workspace user by id.
+func (h *Hub) slackUser(id string) *slack.User {
+	if h.slackInfo == nil {
+		return nil
+	}
+	for i := range h.slackInfo.Users {
+		if u := &h.slackInfo.Users[i]; u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// the web api calls we make ourselves shouldn't hang forever either
+var slackAPIClient = &http.Client{Timeout: 30 * time.Second}
+
+// callSlack calls a slack web api method ourselves, decoding the response into
+// result, for what our slack client doesn't decode.
+func callSlack(method string, values url.Values, result interface{}) error {
+	resp, err := slackAPIClient.PostForm(slack.SLACK_API+method, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return fmt.Errorf("%s responded %s", method, resp.Status)
+	}
+	if !status.Ok {
+		return fmt.Errorf("%s failed: %s", method, status.Error)
+	}
+	return json.Unmarshal(body, result)
+}
+
 func (h *Hub) handleInbox(c *ClientMessage) {
 	// TODO send error message events to client
 	raw, err := DecodeClientMessage(c)
@@ -147,6 +394,9 @@ func (h *Hub) handleInbox(c *ClientMessage) {
 		log.Printf("error: %s\n", err)
 		return
 	}
+	// the hub goroutine may re-identify the client while we work, eg: for a
+	// role grant, so go by who they are now
+	id := h.identityOf(c.Client)
 	switch m := raw.(type) {
 	case *ClientMessageHistory:
 		channelID := h.resolveSlackChannel(m.ChannelID)
@@ -154,99 +404,451 @@ func (h *Hub) handleInbox(c *ClientMessage) {
 			log.Printf("error: no channel found matching %s\n", m.ChannelID)
 			return
 		}
+		if !h.canAccess(id, channelID) {
+			log.Printf("warn: refusing history for channel %s outside of client's invite\n", channelID)
+			return
+		}
 		var username string
-		if c.Client.User != nil {
-			username = c.Client.User.Username
+		if id != nil {
+			username = id.User.Username
 		} else {
 			username = "<anonymous>"
 		}
+		// in post-only channels, visitors only get their own messages back,
+		// and in help-desk channels only their own thread
+		var previous [][]byte
+		switch h.channelMode(id, channelID) {
+		case ChannelPostOnly:
+			if id == nil {
+				return
+			}
+			previous = h.previousMessages(channelID, m.Limit, &id.Subject)
+		case ChannelHelpDesk:
+			if id == nil {
+				return
+			}
+			threadTs := h.helpDesk.thread(channelID, id.Subject)
+			if threadTs == "" {
+				return
+			}
+			previous = h.threadMessages(channelID, threadTs, m.Limit)
+		default:
+			previous = h.previousMessages(channelID, m.Limit, nil)
+		}
 		log.Printf("sending previous messages for channel %s to client %s\n", channelID, username)
-		for _, prevMessage := range h.previousMessages(channelID, m.Limit) {
-			c.Client.send <- prevMessage
+		for _, prevMessage := range previous {
+			c.Client.deliver(prevMessage)
+		}
+	case *ClientMessageThreadHistory:
+		channelID := h.resolveSlackChannel(m.ChannelID)
+		if channelID == "" {
+			log.Printf("error: no channel found matching %s\n", m.ChannelID)
+			return
+		}
+		if !h.canAccess(id, channelID) {
+			log.Printf("warn: refusing thread history for channel %s outside of client's invite\n", channelID)
+			return
+		}
+		switch h.channelMode(id, channelID) {
+		case ChannelPostOnly:
+			// threads are other people's messages
+			return
+		case ChannelHelpDesk:
+			if id == nil || h.helpDesk.owner(channelID, m.ThreadTs) != id.Subject {
+				log.Printf("warn: refusing thread history for someone else's help-desk thread %s\n", m.ThreadTs)
+				return
+			}
+		}
+		log.Printf("sending thread %s in channel %s to client\n", m.ThreadTs, channelID)
+		for _, threadMessage := range h.threadMessages(channelID, m.ThreadTs, m.Limit) {
+			c.Client.deliver(threadMessage)
+		}
+	case *ClientMessageSubscribe:
+		// access is checked per message, since it can change as the client authenticates
+		channelID := h.resolveSlackChannel(m.ChannelID)
+		if channelID == "" {
+			log.Printf("error: no channel found matching %s to subscribe to\n", m.ChannelID)
+			return
+		}
+		h.subscribe(c.Client, channelID)
+	case *ClientMessageUnsubscribe:
+		if channelID := h.resolveSlackChannel(m.ChannelID); channelID != "" {
+			h.unsubscribe(c.Client, channelID)
 		}
 	case *ClientMessageSend:
-		if c.Client.User == nil {
+		if id == nil {
 			log.Printf("warn: skipping message send because user is un-authed\n")
 			return
 		}
+		if h.revoked.isRevoked(id) {
+			log.Printf("warn: skipping message send because identity %s was revoked\n", id.User.Username)
+			h.unidentify(c.Client)
+			c.Client.deliver(EncodeAuthErrorMessage(AuthErrorRevoked, "identity was revoked", false))
+			return
+		}
 		channelID := h.resolveSlackChannel(m.ChannelID)
 		if channelID == "" {
-			log.Printf("error: no channel found matching %s (skipping sending as client %s)\n", m.ChannelID, c.Client.User.Username)
+			log.Printf("error: no channel found matching %s (skipping sending as client %s)\n", m.ChannelID, id.User.Username)
+			return
+		}
+		if !h.canAccess(id, channelID) {
+			log.Printf("warn: refusing send to channel %s outside of client %s's invite\n", channelID, id.User.Username)
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, "you weren't invited to that channel"))
+			return
+		}
+		if h.channelMode(id, channelID) == ChannelReadOnly {
+			log.Printf("warn: refusing send to read-only channel %s as client %s\n", channelID, id.User.Username)
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, "this channel is read-only"))
 			return
 		}
-		log.Printf("sending as client %s to %s\n", c.Client.User.Username, channelID)
-		gravatarURL := fmt.Sprintf("https://www.gravatar.com/avatar/%x?d=retro", md5.Sum([]byte(c.Client.User.Username)))
-		_, _, err = h.slack.PostMessage(channelID, m.Text, slack.PostMessageParameters{
-			Username: c.Client.User.Username,
-			IconURL:  gravatarURL,
-		})
+		text, warnings, err := h.outbound.sanitize(m.Text, id.Role == RoleModerator, h)
+		if err != nil {
+			log.Printf("warn: refusing send as client %s - %s\n", id.User.Username, err)
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, err.Error()))
+			return
+		}
+		if len(warnings) != 0 {
+			c.Client.deliver(EncodeMessageWarningMessage(m.ChannelID, strings.Join(warnings, ", ")))
+		}
+		threadTs, err := h.replyThread(id, channelID, m.ThreadTs)
+		if err != nil {
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, err.Error()))
+			return
+		}
+		// only what's actually posted counts against the limit
+		if id.Role == RoleVisitor && !h.sendLimit.allow(id.Subject) {
+			log.Printf("warn: skipping message send because client %s is over the rate limit\n", id.User.Username)
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, "you're sending messages too quickly, slow down"))
+			return
+		}
+		// visitors only see their own posts in these, so we need to know whose they are
+		posted := h.posts.expect(channelID, id.User.Username, id.Subject)
+		if h.channelMode(id, channelID) == ChannelHelpDesk {
+			log.Printf("sending as client %s to their help-desk thread in %s\n", id.User.Username, channelID)
+			// only until their thread is known; after that it's routed by thread
+			defer posted("")
+			if _, err := h.postHelpDeskMessage(id, channelID, text); err != nil {
+				log.Printf("error: failed to send - %s\n", err)
+			}
+			return
+		}
+		log.Printf("sending as client %s to %s\n", id.User.Username, channelID)
+		_, ts, err := h.slack.PostMessage(channelID, text, visitorPostParams(id.User.Username, threadTs))
 		if err != nil {
 			log.Printf("error: failed to send - %s\n", err)
 		}
+		if h.channelModeFor(channelID) != ChannelPostOnly {
+			ts = ""
+		}
+		posted(ts)
+	case *ClientMessageTyping:
+		h.sendTyping(id, m.ChannelID)
+	case *ClientMessageReact:
+		if id == nil {
+			log.Printf("warn: skipping reaction because user is un-authed\n")
+			return
+		}
+		if h.revoked.isRevoked(id) {
+			log.Printf("warn: skipping reaction because identity %s was revoked\n", id.User.Username)
+			h.unidentify(c.Client)
+			c.Client.deliver(EncodeAuthErrorMessage(AuthErrorRevoked, "identity was revoked", false))
+			return
+		}
+		channelID := h.resolveSlackChannel(m.ChannelID)
+		if channelID == "" || !h.canAccess(id, channelID) {
+			log.Printf("error: no channel found matching %s (skipping reaction as client %s)\n", m.ChannelID, id.User.Username)
+			return
+		}
+		if mode := h.channelMode(id, channelID); mode == ChannelPostOnly || mode == ChannelHelpDesk {
+			// visitors can't see the other messages, so can't react to them
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, "reactions aren't available in this channel"))
+			return
+		}
+		if id.Role == RoleVisitor && !h.reactLimit.allow(id.Subject) {
+			log.Printf("warn: skipping reaction because client %s is over the rate limit\n", id.User.Username)
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, "you're reacting too quickly, slow down"))
+			return
+		}
+		ref := slack.NewRefToMessage(channelID, m.Ts)
+		if m.Remove {
+			log.Printf("removing reaction %s to %s in %s for client %s\n", m.Reaction, m.Ts, channelID, id.User.Username)
+			err = h.slack.RemoveReaction(m.Reaction, ref)
+		} else {
+			log.Printf("adding reaction %s to %s in %s for client %s\n", m.Reaction, m.Ts, channelID, id.User.Username)
+			err = h.slack.AddReaction(m.Reaction, ref)
+		}
+		if err != nil {
+			// eg: already_reacted, invalid_name
+			log.Printf("error: failed to react - %s\n", err)
+			c.Client.deliver(EncodeMessageRejectedMessage(m.ChannelID, fmt.Sprintf("couldn't react: %s", err)))
+		}
+	case *ClientMessageModerate:
+		if id == nil || id.Role != RoleModerator {
+			log.Printf("warn: skipping %s moderation because client isn't a moderator\n", m.Action)
+			c.Client.deliver(EncodeModerationResultMessage(m.Action, m.Username, fmt.Errorf("only moderators can do that")))
+			return
+		}
+		log.Printf("moderator %s requested %s (%s%s %s)\n", id.User.Username, m.Action, m.Username, m.ChannelID, m.Ts)
+		switch m.Action {
+		case "ban":
+			if strings.EqualFold(m.Username, id.User.Username) {
+				c.Client.deliver(EncodeModerationResultMessage(m.Action, m.Username, fmt.Errorf("you can't ban yourself")))
+				return
+			}
+			h.BanUsername(m.Username)
+			c.Client.deliver(EncodeModerationResultMessage(m.Action, m.Username, nil))
+		case "unban":
+			var err error
+			if !h.UnbanUsername(m.Username) {
+				err = fmt.Errorf("%s isn't banned", m.Username)
+			}
+			c.Client.deliver(EncodeModerationResultMessage(m.Action, m.Username, err))
+		case "delete":
+			channelID := h.resolveSlackChannel(m.ChannelID)
+			if channelID == "" {
+				c.Client.deliver(EncodeModerationResultMessage(m.Action, m.Ts, fmt.Errorf("no channel found matching %s", m.ChannelID)))
+				return
+			}
+			_, _, err := h.slack.DeleteMessage(channelID, m.Ts)
+			if err != nil {
+				log.Printf("error: failed to delete message %s in %s - %s\n", m.Ts, channelID, err)
+			}
+			c.Client.deliver(EncodeModerationResultMessage(m.Action, m.Ts, err))
+		}
+	case *ClientMessageNick:
+		if id == nil {
+			log.Printf("warn: skipping nick change because user is un-authed\n")
+			return
+		}
+		if id.User.Verified {
+			c.Client.deliver(EncodeNickRejectedMessage(m.Username, "verified identities keep the name they logged in with"))
+			return
+		}
+		if err := validateNick(m.Username, h.reservedNames, h.slackInfo.Users, h.displayNames); err != nil {
+			log.Printf("rejecting nick %s for client %s - %s\n", m.Username, id.User.Username, err)
+			c.Client.deliver(EncodeNickRejectedMessage(m.Username, err.Error()))
+			return
+		}
+		if err := h.names.reserve(m.Username, id.Subject, time.Now().Add(h.tokenTTL)); err != nil {
+			log.Printf("rejecting nick %s for client %s - %s\n", m.Username, id.User.Username, err)
+			c.Client.deliver(EncodeNickRejectedMessage(m.Username, "name is already in use"))
+			return
+		}
+		renamed := *id
+		renamed.User = &User{Username: m.Username}
+		signed, signedToken, err := signUserJWT(h.keys, &renamed, h.tokenTTL)
+		if err != nil {
+			log.Printf("error: failed to sign token for nick %s - %s\n", m.Username, err)
+			return
+		}
+		log.Printf("client %s is now known as %s\n", id.User.Username, signed.User.Username)
+		h.identify(c.Client, signed, signedToken, nil)
 	case *ClientMessageAuth:
-		if m.Token == "" {
-			// generate new identity
-			// TODO make sure identity isn't already in use for anon sockets
-			user, signedToken, err := generateSignedJWT(h.jwtSecret)
+		h.handleAuth(c.Client, id, m)
+	}
+}
+
+// handleAuth identifies a client from the token they sent, or a brand new identity,
+// re-issuing the token when it needs renewing or an invite widened its scope.
+// current is who the client was until now.
+func (h *Hub) handleAuth(c *Client, current *identity, m *ClientMessageAuth) {
+	var id *identity
+	var signedToken string
+	var warning *string
+	reissue := false
+
+	if m.Token == "" {
+		// generate new identity
+		var err error
+		id, signedToken, err = generateSignedJWT(h.keys, h.names, h.tokenTTL)
+		if err != nil {
+			log.Printf("error: failed to generate new token on auth request - %s\n", err)
+			return
+		}
+		log.Printf("sending new identity %s to client\n", id.User.Username)
+	} else {
+		// check provided identity, optionally generating a new jwt
+		verified, token, err := verifySignedJWT(h.keys, m.Token)
+		if err == nil && h.revoked.isRevoked(verified) {
+			err = authErrorf(AuthErrorRevoked, "Token or identity %s was revoked", verified.User.Username)
+		}
+		if err == nil {
+			// the name may have been given to someone else while this token sat unused
+			err = h.names.reserve(verified.User.Username, verified.Subject, verified.ExpiresAt)
+		}
+		if err != nil {
+			reason := AuthErrorMalformed
+			if authErr, ok := err.(*AuthError); ok {
+				reason = authErr.Reason
+			} else if err == errUsernameTaken {
+				reason = AuthErrorUsernameTaken
+			}
+			if h.authFailurePolicy == AuthFailureReject || reason == AuthErrorRevoked {
+				// leave it to the client to ask for a new identity (or log in)
+				log.Printf("error: failed to verify jwt on auth request, rejecting (%s) - %s\n", m.Token, err)
+				h.unidentify(c)
+				c.deliver(EncodeAuthErrorMessage(reason, err.Error(), false))
+				return
+			}
+			log.Printf("error: failed to verify jwt on auth request, generating new token (%s) - %s\n", m.Token, err)
+			c.deliver(EncodeAuthErrorMessage(reason, err.Error(), true))
+			id, signedToken, err = generateSignedJWT(h.keys, h.names, h.tokenTTL)
 			if err != nil {
 				log.Printf("error: failed to generate new token on auth request - %s\n", err)
 				return
 			}
-			log.Printf("sending new identity %s to client\n", user.Username)
-			c.Client.User = user
-			c.Client.send <- EncodeAuthMessage(signedToken, nil)
+			log.Printf("sending re-generated identity %s to client\n", id.User.Username)
+			warn := "invalid identity provided. generated new identity."
+			warning = &warn
 		} else {
-			// check provided identity, optionally generating a new jwt
-			user, _, err := verifySignedJWT(h.jwtSecret, m.Token)
-			if err != nil {
-				// TODO probably just send back an error instead of generating an interm identity
-				log.Printf("error: failed to verify jwt on auth request, generating new token (%s) - %s\n", m.Token, err)
-				user, signedToken, err := generateSignedJWT(h.jwtSecret)
-				if err != nil {
-					log.Printf("error: failed to generate new token on auth request - %s\n", err)
-					return
-				}
-				log.Printf("sending re-generated identity %s to client\n", user.Username)
-				warn := "invalid identity provided. generated new identity."
-				c.Client.User = user
-				c.Client.send <- EncodeAuthMessage(signedToken, &warn)
+			id, signedToken = verified, m.Token
+			// role was changed by an admin, close to expiry or signed with a rotated-out key;
+			// re-issue for the same user
+			if roleChanged := h.applyRoleGrant(id); roleChanged || time.Until(id.ExpiresAt) < h.tokenRenewWithin || !h.keys.isCurrent(token) {
+				log.Printf("verified token for identity %s, renewing (was expiring %s, kid %v)\n", id.User.Username, id.ExpiresAt, token.Header["kid"])
+				reissue = true
 			} else {
-				// TODO this could be where we extend the exp claim
-				log.Printf("verified token for identity %s\n", user.Username)
-				c.Client.User = user
-				c.Client.send <- EncodeAuthMessage(m.Token, nil)
+				log.Printf("verified token for identity %s\n", id.User.Username)
 			}
 		}
 	}
+
+	// an invite's scope stays with the connection, so dropping the token for a
+	// fresh anonymous identity doesn't shake it off
+	if current != nil && current.Channels != nil && id.Channels == nil && !id.User.Verified {
+		log.Printf("identity %s keeps the invite scope of the connection, %v\n", id.User.Username, current.Channels)
+		id.Channels = current.Channels
+		reissue = true
+	}
+
+	if m.Invite != "" {
+		changed, err := h.redeemInvite(id, m.Invite)
+		if err != nil {
+			log.Printf("warn: couldn't redeem invite for identity %s - %s\n", id.User.Username, err)
+			c.deliver(EncodeInviteErrorMessage(err.Error()))
+		} else if changed {
+			log.Printf("identity %s redeemed an invite, now scoped to %v\n", id.User.Username, id.Channels)
+			reissue = true
+		}
+	}
+
+	if reissue {
+		renewed, renewedToken, err := signUserJWT(h.keys, id, h.tokenTTL)
+		if err != nil {
+			log.Printf("error: failed to renew token for identity %s - %s\n", id.User.Username, err)
+			return
+		}
+		// extend the reservation; this can't conflict since we hold the name as of verification
+		h.names.reserve(renewed.User.Username, renewed.Subject, renewed.ExpiresAt)
+		id, signedToken = renewed, renewedToken
+	}
+	h.identify(c, id, signedToken, warning)
+
+	// the channel list (and modes) sent on connect didn't know who they were
+	if h.inviteOnly || id.Channels != nil || id.Role == RoleModerator {
+		c.deliver(h.welcomePayload(id))
+	}
+}
+
+// applyRoleGrant swaps in any role an admin granted the identity, reporting
+// whether it differed from the one in its token.
+func (h *Hub) applyRoleGrant(id *identity) bool {
+	role, ok := h.roles.roleFor(id.Subject)
+	if !ok || role == id.Role {
+		return false
+	}
+	id.Role = role
+	return true
+}
+
+// identityOf is who a client is right now, or nil if they haven't authenticated.
+// their identity belongs to the hub goroutine, so this mustn't run on it. the
+// identity itself is never changed, only replaced, so it's safe to hold on to.
+func (h *Hub) identityOf(c *Client) *identity {
+	done := make(chan *identity, 1)
+	h.exec <- func() {
+		done <- c.identity
+	}
+	return <-done
 }
 
-func (h *Hub) previousMessages(channelID string, limit int) [][]byte {
+// setIdentity binds an identity (or none) to a client on the hub goroutine,
+// which owns it, returning once it's done.
+func (h *Hub) setIdentity(c *Client, id *identity) {
+	done := make(chan struct{})
+	h.exec <- func() {
+		if id == nil {
+			c.User, c.identity = nil, nil
+			c.setTokenExpiry(time.Time{}, 0)
+		} else {
+			c.User, c.identity = id.User, id
+			c.setTokenExpiry(id.ExpiresAt, h.tokenRenewWithin)
+		}
+		close(done)
+	}
+	<-done
+}
+
+// unidentify drops whatever identity the client had.
+func (h *Hub) unidentify(c *Client) {
+	h.setIdentity(c, nil)
+}
+
+// identify binds an identity to the client and sends them the token for it.
+func (h *Hub) identify(c *Client, id *identity, signedToken string, warning *string) {
+	h.setIdentity(c, id)
+	c.deliver(EncodeAuthMessage(signedToken, warning))
+}
+
+// previousMessages fetches recent history for a channel, optionally only
+// messages posted by the visitor whose subject is onlyFrom.
+func (h *Hub) previousMessages(channelID string, limit int, onlyFrom *string) [][]byte {
 	previous := [][]byte{}
-	messageQuery := slack.NewHistoryParameters()
-	messageQuery.Count = limit
+	if !h.channelVisible(channelID) {
+		log.Printf("warn: refusing history for filtered channel %s\n", channelID)
+		return previous
+	}
 	// TODO allow requesting older history upon scroll
-	history, err := h.slack.GetChannelHistory(channelID, messageQuery)
+	messages, err := h.channelHistory(channelID, limit)
 	if err != nil {
 		log.Printf("error: %s\n", err)
 		return previous
-	} else if history.Messages == nil {
-		return previous
 	}
 
 	// push oldest -> newest
-	for i := len(history.Messages) - 1; i >= 0; i-- {
-		m := history.Messages[i]
-		if !ClientHandlesMessage(&m) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		m, blocks := messages[i].Message, newChatBlocks(messages[i].Blocks, h)
+		h.attributeUpload(channelID, &m.Msg)
+		if !ClientHandlesMessage(&m, blocks) {
 			//log.Printf("history %s: dropping %#v", channelID, ev)
 			continue
 		}
+		if onlyFrom != nil && h.postedBy(channelID, &m) != *onlyFrom {
+			continue
+		}
 		m.Channel = channelID // channel is unset in slack response, but our client expects it
-		previous = append(previous, EncodeMessageEvent(h.slack, (*slack.MessageEvent)(&m)))
+		previous = append(previous, EncodeMessageEvent(h.slack, h, (*slack.MessageEvent)(&m), blocks))
 	}
 	return previous
 }
-func (h *Hub) welcomePayload(c *Client) []byte {
-	return EncodeWelcomePayload(h.slackInfo, h.customEmoji, h.teamInfo)
+
+// visitorPostParams posts as a visitor, under their name and gravatar. their
+// text is already escaped (see outboundPolicy.sanitize), and its formatting
+// should be rendered, so it's sent as mrkdwn without escaping it again.
+func visitorPostParams(username, threadTs string) slack.PostMessageParameters {
+	params := slack.NewPostMessageParameters()
+	params.Username = username
+	params.IconURL = fmt.Sprintf("https://www.gravatar.com/avatar/%x?d=retro", md5.Sum([]byte(username)))
+	params.ThreadTimestamp = threadTs
+	params.EscapeText = false
+	return params
+}
+func (h *Hub) welcomePayload(id *identity) []byte {
+	return EncodeWelcomePayload(h.slackInfo, h.customEmoji, h.teamInfo, func(channelID string) bool {
+		return h.channelVisible(channelID) && h.canAccess(id, channelID)
+	}, func(channelID string) string {
+		return h.channelMode(id, channelID)
+	}, h.agentsOnline)
 }
 func (h *Hub) handleSlackEvent(msg slack.RTMEvent) {
 	switch ev := msg.Data.(type) {
@@ -255,7 +857,12 @@ func (h *Hub) handleSlackEvent(msg slack.RTMEvent) {
 	     // Ignore hello
 	*/
 	case *slack.ConnectedEvent:
+		h.presence.load(ev.Info)
 		if h.slackInfo != nil {
+			// who's online may have changed while we were disconnected
+			for _, c := range h.slackInfo.Channels {
+				h.pushAgentsOnline(c.ID)
+			}
 			break
 		}
 		h.slackInfo = ev.Info
@@ -269,7 +876,39 @@ func (h *Hub) handleSlackEvent(msg slack.RTMEvent) {
 		}
 
 	case *slack.MessageEvent:
-		if !ClientHandlesMessage((*slack.Message)(ev)) {
+		if !h.channelVisible(ev.Channel) {
+			if h.logMessages {
+				log.Printf("message %s: dropping message in filtered channel", ev.Channel)
+			}
+			break
+		}
+		switch ev.SubType {
+		case "message_changed":
+			if ev.SubMessage == nil {
+				break
+			}
+			if h.logMessages {
+				log.Printf("message %s: changed %s\n", ev.Channel, ev.SubMessage.Timestamp)
+			}
+			h.attributeUpload(ev.Channel, ev.SubMessage)
+			edited := &slack.Message{Msg: *ev.SubMessage}
+			blocks := h.messageBlocks(ev.Channel, ev.SubMessage)
+			h.broadcast <- h.routeBroadcast(ev.Channel, edited, EncodeMessageUpdatedEvent(h.slack, h, ev, blocks))
+			return
+		case "message_deleted":
+			if h.logMessages {
+				log.Printf("message %s: deleted %s\n", ev.Channel, ev.DeletedTimestamp)
+			}
+			// slack sends the deleted message as previous_message, which our slack
+			// client doesn't decode, so all we know is its ts. in help-desk
+			// channels that's enough to route deleted thread parents, but not replies.
+			deleted := &slack.Message{Msg: slack.Msg{Timestamp: ev.DeletedTimestamp}}
+			h.broadcast <- h.routeBroadcast(ev.Channel, deleted, EncodeMessageDeletedEvent(ev.Channel, ev.DeletedTimestamp))
+			return
+		}
+		h.attributeUpload(ev.Channel, &ev.Msg)
+		blocks := h.messageBlocks(ev.Channel, &ev.Msg)
+		if !ClientHandlesMessage((*slack.Message)(ev), blocks) {
 			if h.logMessages {
 				log.Printf("message %s: dropping %#v", ev.Channel, ev)
 			}
@@ -278,18 +917,30 @@ func (h *Hub) handleSlackEvent(msg slack.RTMEvent) {
 		if h.logMessages {
 			log.Printf("message %s: %#v\n", ev.Channel, ev)
 		}
-		h.broadcast <- EncodeMessageEvent(h.slack, ev)
+		h.broadcast <- h.routeBroadcast(ev.Channel, (*slack.Message)(ev), EncodeMessageEvent(h.slack, h, ev, blocks))
 
 	// TODO periodically update users, emoji, channels, etc and push to client
-	/*case *slack.PresenceChangeEvent:
-	    fmt.Printf("Presence Change: %v\n", ev)
-
+	case *slack.PresenceChangeEvent:
+		h.presenceChanged(ev)
+	/*
 	  case *slack.LatencyReport:
 	    fmt.Printf("Current latency: %v\n", ev.Value)
 
 	  case *slack.RTMError:
 	    fmt.Printf("Error: %s\n", ev.Error())
 	*/
+	case *slack.UserTypingEvent:
+		h.forwardTyping(ev)
+	case *slack.ReactionAddedEvent:
+		if ev.Item.Type == "message" && h.channelVisible(ev.Item.Channel) {
+			reacted := &slack.Message{Msg: slack.Msg{Timestamp: ev.Item.Timestamp}}
+			h.broadcast <- h.routeBroadcast(ev.Item.Channel, reacted, EncodeReactionEvent(true, ev.Item.Channel, ev.Item.Timestamp, ev.Reaction, ev.User))
+		}
+	case *slack.ReactionRemovedEvent:
+		if ev.Item.Type == "message" && h.channelVisible(ev.Item.Channel) {
+			reacted := &slack.Message{Msg: slack.Msg{Timestamp: ev.Item.Timestamp}}
+			h.broadcast <- h.routeBroadcast(ev.Item.Channel, reacted, EncodeReactionEvent(false, ev.Item.Channel, ev.Item.Timestamp, ev.Reaction, ev.User))
+		}
 	case *slack.InvalidAuthEvent:
 		log.Println("rtm error: invalid credentials")
 		break
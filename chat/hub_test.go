@@ -0,0 +1,187 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// visitors can't see, so can't reply to, other visitors' threads in post-only channels
+func TestSendReplyThread(t *testing.T) {
+	f := newFakeSlack(t, nil)
+	defer f.Close()
+	general, feedback := slack.Channel{}, slack.Channel{}
+	general.ID, general.Name = "C1", "general"
+	feedback.ID, feedback.Name = "C2", "feedback"
+	channels, err := newChannelFilter(nil, nil, map[string]string{"feedback": ChannelPostOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _ := newRevocations("")
+	outbound, _ := newOutboundPolicy(nil, false, 0)
+	posts, _ := newVisitorPosts("", 0)
+	h := &Hub{
+		slack:     slack.New("token"),
+		slackInfo: &slack.Info{User: &slack.UserDetails{ID: "UME"}, Channels: []slack.Channel{general, feedback}},
+		channels:  channels,
+		revoked:   revoked,
+		outbound:  outbound,
+		posts:     posts,
+		exec:      make(chan func()),
+	}
+	go func() {
+		for f := range h.exec {
+			f()
+		}
+	}()
+	defer close(h.exec)
+	user := &User{Username: "bob"}
+	c := &Client{User: user, identity: &identity{Subject: "anon|bob", User: user, Role: RoleVisitor}, send: make(chan []byte, 10)}
+
+	tests := []struct {
+		channel, threadTs string
+		want              string
+		posted            bool
+	}{
+		{"general", "1.1", "1.1", true},
+		{"general", "", "", true},
+		{"feedback", "1.1", "", true},
+		{"general", "1.1&channel=C2", "", false},
+	}
+	for _, test := range tests {
+		before := len(f.called("chat.postMessage"))
+		h.handleInbox(&ClientMessage{Client: c, Raw: encode(map[string]string{"type": "message", "channel_id": test.channel, "text": "hi", "thread_ts": test.threadTs})})
+		posts := f.called("chat.postMessage")
+		if !test.posted {
+			if len(posts) != before || len(c.send) != 1 {
+				t.Errorf("%s %q: posted %d, sent %d; want it rejected", test.channel, test.threadTs, len(posts)-before, len(c.send))
+			}
+			<-c.send
+			continue
+		}
+		if len(posts) != before+1 {
+			t.Fatalf("%s %q: nothing posted", test.channel, test.threadTs)
+		}
+		if got := posts[before].Get("thread_ts"); got != test.want {
+			t.Errorf("%s %q: posted to thread %q, want %q", test.channel, test.threadTs, got, test.want)
+		}
+	}
+}
+
+// run with -race: the hub reads clients' identities while their messages are
+// handled, and may let go of them before a reply goes out
+func TestInboxLeavesIdentityToHub(t *testing.T) {
+	h := newAdminHub(t)
+	defer close(h.exec)
+	h.slackInfo = &slack.Info{}
+	soon := time.Now().Add(time.Minute)
+	if err := h.names.reserve("bob", "anon|bob", soon); err != nil {
+		t.Fatal(err)
+	}
+	bob := newAdminClient(h, "anon|bob", "bob", soon)
+
+	stop, stopped := make(chan bool), make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				h.clientsWhere(func(c *Client) bool { return c.identity != nil && c.User.Username == "robert" })
+			}
+		}
+	}()
+	h.handleInbox(&ClientMessage{Client: bob, Raw: encode(map[string]string{"type": "nick", "username": "robert"})})
+	close(stop)
+	<-stopped
+	if id := h.identityOf(bob); id == nil || id.User.Username != "robert" || id.Subject != "anon|bob" {
+		t.Fatalf("bob is now %+v", id)
+	}
+	if len(bob.send) != 1 {
+		t.Errorf("bob was sent %d messages, want his new token", len(bob.send))
+	}
+
+	// a reply to a client that's gone, and too backed up to take it, is dropped
+	for len(bob.send) < cap(bob.send) {
+		bob.send <- []byte("{}")
+	}
+	h.exec <- func() { h.removeClient(bob) }
+	replied := make(chan bool)
+	go func() {
+		h.handleInbox(&ClientMessage{Client: bob, Raw: encode(map[string]string{"type": "nick", "username": "x"})})
+		close(replied)
+	}()
+	select {
+	case <-replied:
+	case <-time.After(time.Second):
+		t.Error("a reply to a client that's gone blocked")
+	}
+}
+
+// sends and reactions that are refused anyway don't use up a visitor's limits
+func TestLimitsOnlyCountWhatGoesOut(t *testing.T) {
+	f := newFakeSlack(t, nil)
+	defer f.Close()
+	general, news := slack.Channel{}, slack.Channel{}
+	general.ID, general.Name = "C1", "general"
+	news.ID, news.Name = "C2", "news"
+	channels, err := newChannelFilter(nil, nil, map[string]string{"news": ChannelReadOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _ := newRevocations("")
+	outbound, _ := newOutboundPolicy(nil, false, 0)
+	posts, _ := newVisitorPosts("", 0)
+	h := &Hub{
+		slack:      slack.New("token"),
+		slackInfo:  &slack.Info{User: &slack.UserDetails{ID: "UME"}, Channels: []slack.Channel{general, news}},
+		channels:   channels,
+		revoked:    revoked,
+		outbound:   outbound,
+		posts:      posts,
+		sendLimit:  newRateLimiter(time.Hour, 1),
+		reactLimit: newRateLimiter(time.Hour, 1),
+		exec:       make(chan func()),
+	}
+	go func() {
+		for f := range h.exec {
+			f()
+		}
+	}()
+	defer close(h.exec)
+	user := &User{Username: "bob"}
+	c := &Client{User: user, identity: &identity{Subject: "anon|bob", User: user, Role: RoleVisitor}, send: make(chan []byte, 10)}
+
+	for _, test := range []struct {
+		channel string
+		posted  bool
+	}{
+		{"nowhere", false},
+		{"news", false},
+		{"general", true},
+		{"general", false},
+	} {
+		before := len(f.called("chat.postMessage"))
+		h.handleInbox(&ClientMessage{Client: c, Raw: encode(map[string]string{"type": "message", "channel_id": test.channel, "text": "hi"})})
+		if posted := len(f.called("chat.postMessage")) > before; posted != test.posted {
+			t.Errorf("%s: posted = %v, want %v", test.channel, posted, test.posted)
+		}
+	}
+
+	for _, test := range []struct {
+		channel string
+		reacted bool
+	}{
+		{"nowhere", false},
+		{"general", true},
+		{"general", false},
+	} {
+		before := len(f.called("reactions.add"))
+		h.handleInbox(&ClientMessage{Client: c, Raw: encode(map[string]string{"type": "react", "channel_id": test.channel, "ts": "1.1", "reaction": "tada"})})
+		if reacted := len(f.called("reactions.add")) > before; reacted != test.reacted {
+			t.Errorf("%s: reacted = %v, want %v", test.channel, reacted, test.reacted)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// invite tokens are signed with the same keys as identities, but carry an
+// audience so that neither can be passed off as the other.
+const inviteAudience = "invite"
+
+var errInviteUsedUp = errors.New("invite has already been used the maximum number of times")
+
+// invite is a signed link letting visitors into a set of channels.
+type invite struct {
+	ID string
+	// channel names or ids, resolved when redeemed
+	Channels  []string
+	ExpiresAt time.Time
+	// how many distinct identities may redeem it, 0 for unlimited
+	MaxUses int
+}
+
+func signInvite(keys *keyring, channels []string, ttl time.Duration, maxUses int) (*invite, string, error) {
+	if len(channels) == 0 {
+		return nil, "", fmt.Errorf("invite needs at least one channel")
+	}
+	if maxUses < 0 {
+		return nil, "", fmt.Errorf("max uses can't be negative")
+	}
+	jti, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	inv := &invite{ID: jti, Channels: channels, ExpiresAt: time.Unix(now.Add(ttl).Unix(), 0), MaxUses: maxUses}
+
+	token := jwt.NewWithClaims(keys.current.method, jwt.MapClaims{
+		"iss":      TokenISS,
+		"aud":      inviteAudience,
+		"jti":      inv.ID,
+		"channels": inv.Channels,
+		"max_uses": inv.MaxUses,
+		"tv":       TokenVersion,
+		"iat":      now.Unix(),
+		"exp":      inv.ExpiresAt.Unix(),
+	})
+	token.Header["kid"] = keys.current.id
+
+	tokenString, err := token.SignedString(keys.current.signKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return inv, tokenString, nil
+}
+
+func verifyInvite(keys *keyring, tokenString string) (*invite, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		key, err := keys.lookup(token)
+		if err != nil {
+			return nil, err
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %s", authErrorFromParse(err))
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("invalid invite: malformed claims")
+	}
+	if !claims.VerifyIssuer(TokenISS, true) || !claims.VerifyAudience(inviteAudience, true) {
+		return nil, fmt.Errorf("invalid invite: not an invite")
+	}
+	tvRaw, _ := claims["tv"].(string)
+	if subtle.ConstantTimeCompare([]byte(tvRaw), []byte(TokenVersion)) != 1 {
+		return nil, fmt.Errorf("invalid invite: unexpected version %s", tvRaw)
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("invalid invite: missing exp")
+	}
+
+	inv := &invite{}
+	inv.ID, _ = claims["jti"].(string)
+	inv.Channels, ok = stringsClaim(claims["channels"])
+	if !ok || len(inv.Channels) == 0 || inv.ID == "" {
+		return nil, fmt.Errorf("invalid invite: missing jti or channels")
+	}
+	maxUses, _ := claims["max_uses"].(float64)
+	inv.MaxUses = int(maxUses)
+	exp, _ := claims["exp"].(float64)
+	inv.ExpiresAt = time.Unix(int64(exp), 0)
+	return inv, nil
+}
+
+// stringsClaim converts a json array claim back into strings.
+func stringsClaim(raw interface{}) ([]string, bool) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, 0, len(list))
+	for _, v := range list {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, s)
+	}
+	return strs, true
+}
+
+func inviteURL(publicURL, token string) string {
+	return fmt.Sprintf("%s/?invite=%s", publicURL, url.QueryEscape(token))
+}
+
+// NewInviteURL signs an invite with the configured keys, for generating links
+// without a running server.
+func NewInviteURL(cfg *Config, channels []string, ttl time.Duration, maxUses int) (string, time.Time, error) {
+	keys, err := newKeyring(cfg)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid jwt keys: %s", err)
+	}
+	inv, token, err := signInvite(keys, channels, ttl, maxUses)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return inviteURL(cfg.Server.PublicURL, token), inv.ExpiresAt, nil
+}
+
+// inviteRedemptions tracks which subjects redeemed each invite, so that max uses
+// counts people rather than page loads. it's optionally mirrored to a json file.
+type inviteRedemptions struct {
+	mu   sync.Mutex
+	path string
+
+	byInvite map[string]*redeemedInvite
+}
+
+type redeemedInvite struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Subjects  []string  `json:"subjects"`
+}
+
+func newInviteRedemptions(path string) (*inviteRedemptions, error) {
+	r := &inviteRedemptions{path: path, byInvite: map[string]*redeemedInvite{}}
+	if path == "" {
+		return r, nil
+	}
+	if err := loadJSONFile(path, &r.byInvite); err != nil {
+		return nil, err
+	}
+	if r.byInvite == nil {
+		r.byInvite = map[string]*redeemedInvite{}
+	}
+	log.Printf("loaded %d redeemed invites from %s\n", len(r.byInvite), path)
+	return r, nil
+}
+
+// redeem records subject as a user of the invite, failing if that would exceed
+// its max uses. redeeming the same invite twice is free.
+func (r *inviteRedemptions) redeem(inv *invite, subject string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	redeemed, ok := r.byInvite[inv.ID]
+	if !ok {
+		redeemed = &redeemedInvite{ExpiresAt: inv.ExpiresAt}
+		r.byInvite[inv.ID] = redeemed
+	}
+	for _, s := range redeemed.Subjects {
+		if s == subject {
+			return nil
+		}
+	}
+	if inv.MaxUses > 0 && len(redeemed.Subjects) >= inv.MaxUses {
+		return errInviteUsedUp
+	}
+	redeemed.Subjects = append(redeemed.Subjects, subject)
+	r.persist()
+	return nil
+}
+
+// persist forgets expired invites and writes the rest out. callers hold mu.
+func (r *inviteRedemptions) persist() {
+	now := time.Now()
+	for id, redeemed := range r.byInvite {
+		if redeemed.ExpiresAt.Before(now) {
+			delete(r.byInvite, id)
+		}
+	}
+	if r.path == "" {
+		return
+	}
+	if err := saveJSONFile(r.path, r.byInvite); err != nil {
+		log.Printf("error: couldn't save invite redemptions to %s - %s\n", r.path, err)
+	}
+}
+
+// CreateInvite signs an invite link for channels (names or ids), checking that
+// they exist when we're connected to slack.
+func (h *Hub) CreateInvite(channels []string, ttl time.Duration, maxUses int) (string, time.Time, error) {
+	if h.slackInfo != nil {
+		for _, c := range channels {
+			if h.resolveSlackChannel(c) == "" {
+				return "", time.Time{}, fmt.Errorf("no channel found matching %s", c)
+			}
+		}
+	}
+	if ttl <= 0 {
+		ttl = h.inviteTTL
+	}
+	inv, token, err := signInvite(h.keys, channels, ttl, maxUses)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	log.Printf("created invite %s for %v (expires %s, max uses %d)\n", inv.ID, inv.Channels, inv.ExpiresAt, inv.MaxUses)
+	return inviteURL(h.publicURL, token), inv.ExpiresAt, nil
+}
+
+// redeemInvite scopes an identity to an invite's channels, adding to any it was
+// already scoped to. it reports whether the scope changed.
+func (h *Hub) redeemInvite(id *identity, tokenString string) (bool, error) {
+	inv, err := verifyInvite(h.keys, tokenString)
+	if err != nil {
+		return false, err
+	}
+	if err := h.invites.redeem(inv, id.Subject); err != nil {
+		return false, err
+	}
+	scope := append([]string{}, id.Channels...)
+	changed := id.Channels == nil
+	for _, c := range inv.Channels {
+		if !containsString(scope, c) {
+			scope = append(scope, c)
+			changed = true
+		}
+	}
+	id.Channels = scope
+	return changed, nil
+}
+
+// canAccess reports whether an identity (nil if the client hasn't
+// authenticated) may read or post in a channel. identities scoped by an invite
+// only get those channels. with INVITE_ONLY, anonymous visitors without an
+// invite get none.
+func (h *Hub) canAccess(id *identity, channelID string) bool {
+	if id != nil && id.Role == RoleModerator {
+		return true
+	}
+	if id == nil || id.Channels == nil {
+		return !h.inviteOnly || (id != nil && id.User.Verified)
+	}
+	for _, allowed := range id.Channels {
+		if allowed == channelID || h.resolveSlackChannel(allowed) == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
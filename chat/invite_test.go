@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// newInviteHub is a hub with #general (C1) and #support (C2), whose exec work
+// runs on a stand-in for the hub goroutine until exec is closed.
+func newInviteHub(t *testing.T) *Hub {
+	h := newAdminHub(t)
+	general, support := slack.Channel{}, slack.Channel{}
+	general.ID, general.Name = "C1", "general"
+	support.ID, support.Name = "C2", "support"
+	h.channels, _ = newChannelFilter(nil, nil, nil)
+	h.slack = slack.New("token")
+	h.slackInfo = &slack.Info{User: &slack.UserDetails{ID: "UME"}, Channels: []slack.Channel{general, support}}
+	h.revoked, _ = newRevocations("")
+	h.outbound, _ = newOutboundPolicy(nil, false, 0)
+	h.posts, _ = newVisitorPosts("", 0)
+	h.invites, _ = newInviteRedemptions("")
+	h.teamInfo = &slack.TeamInfo{Icon: map[string]interface{}{"image_88": ""}}
+	h.presence = newAgentPresence()
+	h.subscribers = map[string]map[*Client]bool{}
+	h.tokenRenewWithin = time.Minute
+	return h
+}
+
+// newInviteClient connects a client that hasn't authenticated yet.
+func newInviteClient(h *Hub) *Client {
+	c := &Client{
+		hub:           h,
+		send:          make(chan []byte, 20),
+		gone:          make(chan struct{}),
+		kick:          make(chan struct{}),
+		tokenExpiry:   make(chan tokenLifetime, 1),
+		subscriptions: map[string]bool{},
+	}
+	h.exec <- func() { h.clients[c] = true }
+	return c
+}
+
+// received empties a client's send channel, returning the types of what it was
+// sent and the last token among them.
+func received(c *Client) (types []string, token string) {
+	for len(c.send) > 0 {
+		var m struct {
+			Type  string `json:"type"`
+			Token string `json:"token"`
+		}
+		json.Unmarshal(<-c.send, &m)
+		types = append(types, m.Type)
+		if m.Type == "auth" {
+			token = m.Token
+		}
+	}
+	return types, token
+}
+
+func TestInviteScope(t *testing.T) {
+	f := newFakeSlack(t, nil)
+	defer f.Close()
+	h := newInviteHub(t)
+	defer close(h.exec)
+	_, invite, err := signInvite(h.keys, []string{"support"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newInviteClient(h)
+	inbox := func(m map[string]string) []string {
+		h.handleInbox(&ClientMessage{Client: c, Raw: encode(m)})
+		types, _ := received(c)
+		return types
+	}
+
+	inbox(map[string]string{"type": "auth", "invite": invite})
+	scoped := h.identityOf(c)
+	if scoped == nil || !reflect.DeepEqual(scoped.Channels, []string{"support"}) {
+		t.Fatalf("identity %+v, want it scoped to support", scoped)
+	}
+
+	// sends, history and live messages outside the invite are refused
+	if types := inbox(map[string]string{"type": "message", "channel_id": "general", "text": "hi"}); len(f.called("chat.postMessage")) != 0 || !reflect.DeepEqual(types, []string{"message-rejected"}) {
+		t.Errorf("send to general: posted %d, sent %v", len(f.called("chat.postMessage")), types)
+	}
+	inbox(map[string]string{"type": "history", "channel_id": "general"})
+	if calls := f.called("channels.history"); len(calls) != 0 {
+		t.Errorf("fetched history for general: %v", calls)
+	}
+	inbox(map[string]string{"type": "subscribe", "channel_id": "general"})
+	inbox(map[string]string{"type": "subscribe", "channel_id": "support"})
+	message := &slack.Message{Msg: slack.Msg{User: "U1", Text: "hi", Timestamp: "1.1"}}
+	for channelID, want := range map[string]bool{"C1": false, "C2": true} {
+		b := h.routeBroadcast(channelID, message, []byte("{}"))
+		sees := make(chan bool)
+		h.exec <- func() { sees <- h.subscribers[channelID][c] && h.canSee(c, b) }
+		if got := <-sees; got != want {
+			t.Errorf("%s: sees live messages = %v, want %v", channelID, got, want)
+		}
+	}
+
+	// and allowed inside it
+	inbox(map[string]string{"type": "message", "channel_id": "support", "text": "hi"})
+	if posts := f.called("chat.postMessage"); len(posts) != 1 || posts[0].Get("channel") != "C2" {
+		t.Errorf("send to support: posted %v", posts)
+	}
+
+	// a fresh identity on the same connection doesn't shake the scope off
+	inbox(map[string]string{"type": "auth"})
+	if fresh := h.identityOf(c); fresh == nil || fresh.Subject == scoped.Subject || !reflect.DeepEqual(fresh.Channels, scoped.Channels) {
+		t.Errorf("fresh identity %+v, want a new one scoped like %+v", fresh, scoped)
+	}
+}
+
+func TestInviteMaxUses(t *testing.T) {
+	f := newFakeSlack(t, nil)
+	defer f.Close()
+	h := newInviteHub(t)
+	defer close(h.exec)
+	_, invite, err := signInvite(h.keys, []string{"support"}, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := func(c *Client, token string) ([]string, string) {
+		h.handleInbox(&ClientMessage{Client: c, Raw: encode(map[string]string{"type": "auth", "token": token, "invite": invite})})
+		return received(c)
+	}
+
+	first, second, third := newInviteClient(h), newInviteClient(h), newInviteClient(h)
+	_, token := auth(first, "")
+	auth(second, "")
+	if types, _ := auth(third, ""); len(types) == 0 || types[0] != "invite-error" {
+		t.Errorf("third visitor was sent %v, want an invite-error", types)
+	}
+	if id := h.identityOf(third); id == nil || id.Channels != nil {
+		t.Errorf("third visitor is %+v, want them unscoped", id)
+	}
+
+	// the same visitor coming back doesn't count again
+	again := newInviteClient(h)
+	if types, _ := auth(again, token); len(types) == 0 || types[0] == "invite-error" {
+		t.Errorf("returning visitor was sent %v", types)
+	}
+	if id := h.identityOf(again); id == nil || id.Subject != h.identityOf(first).Subject || !reflect.DeepEqual(id.Channels, []string{"support"}) {
+		t.Errorf("returning visitor is %+v, want them scoped to support", id)
+	}
+}
@@ -0,0 +1,13 @@
+package chat
+
+import (
+	"net/http"
+)
+
+// ServeJWKS publishes the public half of our token signing keys so that other
+// services can verify visitor identities (the user claim) without our secrets.
+func ServeJWKS(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(encode(hub.keys.publicKeys()))
+}
@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// legacyKeyID is assumed for tokens signed before we started setting kid headers.
+const legacyKeyID = "default"
+
+// ed25519 signing (see eddsa.go)
+const algEdDSA = "EdDSA"
+
+// tokenKey is a named key used to sign and/or verify identity tokens.
+type tokenKey struct {
+	id     string
+	method jwt.SigningMethod
+
+	// signKey is nil for verify-only keys. for hs256, both are the shared secret.
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// keyring holds the key new tokens are signed with, plus any older keys that
+// are still accepted during verification so that rotating the signing key
+// doesn't log out every visitor at once.
+type keyring struct {
+	current *tokenKey
+	keys    map[string]*tokenKey
+}
+
+func newKeyring(cfg *Config) (*keyring, error) {
+	id := cfg.Server.JWTKeyID
+	if id == "" {
+		return nil, fmt.Errorf("signing key requires an id")
+	}
+	current, err := loadSigningKey(id, cfg.Server.JWTAlgorithm, cfg.Server.JWTSecret, cfg.Server.JWTPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	k := &keyring{current: current, keys: map[string]*tokenKey{id: current}}
+	for verifyID, material := range cfg.Server.JWTVerifyKeys {
+		if verifyID == id {
+			return nil, fmt.Errorf("verify-only key %s has the same id as the signing key", verifyID)
+		}
+		key, err := loadVerifyKey(verifyID, material)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[verifyID] = key
+	}
+	return k, nil
+}
+
+// readKeyMaterial resolves "@/path/to/file" references, otherwise returning the value as-is.
+// docker secrets loaded by go-swarmed arrive as the value itself.
+func readKeyMaterial(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	b, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", fmt.Errorf("couldn't read key file: %s", err)
+	}
+	return string(b), nil
+}
+
+func loadSigningKey(id, alg, secret, privateKey string) (*tokenKey, error) {
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		if secret == "" {
+			return nil, fmt.Errorf("%s signing requires JWT_SECRET", alg)
+		}
+		return &tokenKey{id: id, method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}, nil
+	case jwt.SigningMethodRS256.Alg():
+		pem, err := readKeyMaterial(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(pem))
+		if err != nil {
+			return nil, fmt.Errorf("%s signing requires an rsa JWT_PRIVATE_KEY: %s", alg, err)
+		}
+		return &tokenKey{id: id, method: jwt.SigningMethodRS256, signKey: key, verifyKey: &key.PublicKey}, nil
+	case jwt.SigningMethodES256.Alg():
+		pem, err := readKeyMaterial(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwt.ParseECPrivateKeyFromPEM([]byte(pem))
+		if err != nil {
+			return nil, fmt.Errorf("%s signing requires an ecdsa JWT_PRIVATE_KEY: %s", alg, err)
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s signing requires a P-256 JWT_PRIVATE_KEY", alg)
+		}
+		return &tokenKey{id: id, method: jwt.SigningMethodES256, signKey: key, verifyKey: &key.PublicKey}, nil
+	case algEdDSA:
+		pem, err := readKeyMaterial(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return edDSASigningKey(id, pem)
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %s (expected HS256, RS256, ES256 or EdDSA)", alg)
+	}
+}
+
+// loadVerifyKey builds a verify-only key. PEM public keys (rsa, P-256 ecdsa or ed25519) verify
+// asymmetric tokens; anything else is treated as an hs256 secret.
+func loadVerifyKey(id, material string) (*tokenKey, error) {
+	value, err := readKeyMaterial(material)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, fmt.Errorf("verify-only key %s is empty", id)
+	}
+	if !strings.Contains(value, "-----BEGIN") {
+		return &tokenKey{id: id, method: jwt.SigningMethodHS256, verifyKey: []byte(value)}, nil
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(value)); err == nil {
+		return &tokenKey{id: id, method: jwt.SigningMethodRS256, verifyKey: key}, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM([]byte(value)); err == nil && key.Curve == elliptic.P256() {
+		return &tokenKey{id: id, method: jwt.SigningMethodES256, verifyKey: key}, nil
+	}
+	if key, ok := edDSAVerifyKey(id, value); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("verify-only key %s is not an rsa, P-256 ecdsa or ed25519 public key", id)
+}
+
+// lookup finds the key a token claims to be signed with via its kid header,
+// making sure the token's alg matches that key.
+func (k *keyring) lookup(token *jwt.Token) (*tokenKey, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		kid = legacyKeyID
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key: %s", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method for key %s: %v", kid, token.Header["alg"])
+	}
+	return key, nil
+}
+
+// isCurrent reports whether a verified token was signed with the current key.
+func (k *keyring) isCurrent(token *jwt.Token) bool {
+	key, err := k.lookup(token)
+	return err == nil && key == k.current
+}
+
+// jwk is a single public key in a json web key set (rfc 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// rsa
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// ecdsa
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKeys lists every asymmetric key we'd accept, current or verify-only.
+// hs256 secrets are never published.
+func (k *keyring) publicKeys() jwks {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := jwks{Keys: []jwk{}}
+	for _, id := range ids {
+		key := k.keys[id]
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			e := []byte{byte(pub.E >> 24), byte(pub.E >> 16), byte(pub.E >> 8), byte(pub.E)}
+			for len(e) > 1 && e[0] == 0 {
+				e = e[1:]
+			}
+			set.Keys = append(set.Keys, jwk{
+				Kty: "RSA", Kid: id, Alg: key.method.Alg(), Use: "sig",
+				N: jwt.EncodeSegment(pub.N.Bytes()),
+				E: jwt.EncodeSegment(e),
+			})
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			x, y := make([]byte, size), make([]byte, size)
+			xb, yb := pub.X.Bytes(), pub.Y.Bytes()
+			copy(x[size-len(xb):], xb)
+			copy(y[size-len(yb):], yb)
+			set.Keys = append(set.Keys, jwk{
+				Kty: "EC", Kid: id, Alg: key.method.Alg(), Use: "sig",
+				Crv: pub.Curve.Params().Name,
+				X:   jwt.EncodeSegment(x),
+				Y:   jwt.EncodeSegment(y),
+			})
+		default:
+			if k, ok := edDSAJWK(id, key); ok {
+				set.Keys = append(set.Keys, k)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestVerifySignedJWTKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	// signing with rs256 as "new", still accepting hs256 tokens from "old"
+	cfg := &Config{}
+	cfg.Server.JWTKeyID, cfg.Server.JWTAlgorithm, cfg.Server.JWTPrivateKey = "new", "RS256", string(privatePEM)
+	cfg.Server.JWTVerifyKeys = map[string]string{"old": "old-secret", legacyKeyID: "legacy-secret"}
+	keys, err := newKeyring(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  jwt.SigningMethod
+		key     interface{}
+		kid     string
+		reason  string
+		current bool
+	}{
+		{"current key", jwt.SigningMethodRS256, rsaKey, "new", "", true},
+		{"rotated out key", jwt.SigningMethodHS256, []byte("old-secret"), "old", "", false},
+		{"no kid", jwt.SigningMethodHS256, []byte("legacy-secret"), "", "", false},
+		{"unknown kid", jwt.SigningMethodHS256, []byte("old-secret"), "older", AuthErrorBadSignature, false},
+		{"wrong secret", jwt.SigningMethodHS256, []byte("guess"), "old", AuthErrorBadSignature, false},
+		{"someone else's rsa key", jwt.SigningMethodRS256, otherKey, "new", AuthErrorBadSignature, false},
+		// the public key used as an hs256 secret
+		{"alg confusion", jwt.SigningMethodHS256, publicPEM, "new", AuthErrorBadSignature, false},
+		{"rs256 for an hs256 key", jwt.SigningMethodRS256, rsaKey, "old", AuthErrorBadSignature, false},
+		{"alg none", jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "new", AuthErrorBadSignature, false},
+	}
+	for _, test := range tests {
+		token := signTestToken(t, test.method, test.key, test.kid, identityClaims())
+		id, parsed, err := verifySignedJWT(keys, token)
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: rejected: %s", test.name, err)
+			} else if id.Subject != "anon|bob" {
+				t.Errorf("%s: got %+v", test.name, id)
+			} else if keys.isCurrent(parsed) != test.current {
+				t.Errorf("%s: isCurrent = %v, want %v", test.name, !test.current, test.current)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: accepted", test.name)
+			continue
+		}
+		if reason := err.(*AuthError).Reason; reason != test.reason {
+			t.Errorf("%s: rejected as %s, want %s (%s)", test.name, reason, test.reason, err)
+		}
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+	}{
+		{"no kid", func(cfg *Config) { cfg.Server.JWTKeyID = "" }},
+		{"no secret", func(cfg *Config) { cfg.Server.JWTSecret = "" }},
+		{"unknown algorithm", func(cfg *Config) { cfg.Server.JWTAlgorithm = "none" }},
+		{"rs256 without a key", func(cfg *Config) { cfg.Server.JWTAlgorithm = "RS256" }},
+		{"verify key reusing the kid", func(cfg *Config) { cfg.Server.JWTVerifyKeys = map[string]string{"k1": "other"} }},
+		{"empty verify key", func(cfg *Config) { cfg.Server.JWTVerifyKeys = map[string]string{"k0": ""} }},
+		{"bad pem verify key", func(cfg *Config) { cfg.Server.JWTVerifyKeys = map[string]string{"k0": "-----BEGIN PUBLIC KEY-----"} }},
+	}
+	for _, test := range tests {
+		cfg := &Config{}
+		cfg.Server.JWTKeyID, cfg.Server.JWTAlgorithm, cfg.Server.JWTSecret = "k1", "HS256", "secret"
+		test.change(cfg)
+		if _, err := newKeyring(cfg); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
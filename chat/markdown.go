@@ -0,0 +1,242 @@
+package chat
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdFence    = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	mdHeading  = regexp.MustCompile(`^ {0,3}#{1,6}(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRule     = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdQuote    = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	mdBullet   = regexp.MustCompile(`^([ \t]*)[-*+][ \t]+(.*)$`)
+	mdNumbered = regexp.MustCompile(`^([ \t]*)([0-9]{1,9})[.)][ \t]+(.*)$`)
+
+	// slack markup typed by hand, which is left for the sanitizer
+	mdControlSequence = regexp.MustCompile(`^<[^<>]*>`)
+)
+
+// what a backslash can escape in markdown
+const mdPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// slack's formatting for markdown's emphasis
+var mdEmphasis = map[string]string{
+	"**": "*",
+	"__": "*",
+	"*":  "_",
+	"_":  "_",
+	"~~": "~",
+}
+
+// markdownToMrkdwn converts the markdown visitors are likely to type into
+// slack's mrkdwn: emphasis, strikethrough, code, links, headings, quotes and
+// lists. text is passed through inline, which should escape it, and links
+// through link; code is only escaped. spans don't cross lines, and anything
+// slack can't show (tables, html, ...) is left as text. slack has no way to
+// escape its own formatting characters, so \* comes out as a plain *.
+func markdownToMrkdwn(text string, inline func(string) string, link func(url, label string) string) string {
+	c := &mdConverter{inline: inline, link: link}
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	out := []string{}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if m := mdFence.FindStringSubmatch(line); m != nil {
+			// the info string (eg: ```go) has nowhere to go in slack
+			end := len(lines)
+			for j := i + 1; j < len(lines); j++ {
+				closing := strings.TrimSpace(lines[j])
+				if strings.HasPrefix(closing, m[1]) && strings.Trim(closing, m[1][:1]) == "" {
+					end = j
+					break
+				}
+			}
+			code := strings.Join(lines[i+1:end], "\n")
+			out = append(out, "```\n"+escapeMrkdwn(code)+"\n```")
+			i = end
+			continue
+		}
+		var m []string
+		switch {
+		case mdRule.MatchString(line):
+			out = append(out, "───")
+		case mdHeading.MatchString(line):
+			m = mdHeading.FindStringSubmatch(line)
+			if m[1] == "" {
+				out = append(out, "")
+			} else {
+				out = append(out, "*"+c.line(m[1])+"*")
+			}
+		case mdQuote.MatchString(line):
+			m = mdQuote.FindStringSubmatch(line)
+			out = append(out, "&gt; "+c.line(m[1]))
+		case mdBullet.MatchString(line):
+			m = mdBullet.FindStringSubmatch(line)
+			out = append(out, m[1]+"• "+c.line(m[2]))
+		case mdNumbered.MatchString(line):
+			m = mdNumbered.FindStringSubmatch(line)
+			out = append(out, m[1]+m[2]+". "+c.line(m[3]))
+		default:
+			out = append(out, c.line(line))
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+type mdConverter struct {
+	inline func(string) string
+	link   func(url, label string) string
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t'
+}
+
+// line converts a line's inline markdown.
+func (c *mdConverter) line(s string) string {
+	var out, text bytes.Buffer
+	flush := func() {
+		if text.Len() != 0 {
+			out.WriteString(c.inline(text.String()))
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(s); {
+		switch ch := s[i]; {
+		case ch == '\\' && i+1 < len(s) && strings.IndexByte(mdPunctuation, s[i+1]) != -1:
+			text.WriteByte(s[i+1])
+			i += 2
+			continue
+		case ch == '`':
+			ticks := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			if code, end, ok := codeSpan(s, i, ticks); ok {
+				flush()
+				out.WriteString("`" + escapeMrkdwn(code) + "`")
+				i = end
+				continue
+			}
+			text.WriteString(s[i : i+ticks])
+			i += ticks
+			continue
+		case ch == '<':
+			if loc := mdControlSequence.FindStringIndex(s[i:]); loc != nil {
+				text.WriteString(s[i : i+loc[1]])
+				i += loc[1]
+				continue
+			}
+		case ch == '[' || ch == '!' && strings.HasPrefix(s[i+1:], "["):
+			if url, label, end, ok := markdownLink(s, i); ok {
+				flush()
+				out.WriteString(c.link(url, label))
+				i = end
+				continue
+			}
+		case ch == '*' || ch == '_' || ch == '~':
+			if inner, marker, end, ok := emphasis(s, i); ok {
+				flush()
+				out.WriteString(marker + c.line(inner) + marker)
+				i = end
+				continue
+			}
+		}
+		text.WriteByte(s[i])
+		i++
+	}
+	flush()
+	return out.String()
+}
+
+// codeSpan finds the end of a code span opened by ticks backticks at i.
+func codeSpan(s string, i, ticks int) (string, int, bool) {
+	for j := i + ticks; j < len(s); {
+		if s[j] != '`' {
+			j++
+			continue
+		}
+		run := len(s[j:]) - len(strings.TrimLeft(s[j:], "`"))
+		if run == ticks {
+			code := s[i+ticks : j]
+			// `` `a` `` is how markdown puts backticks in code
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+			return code, j + run, true
+		}
+		j += run
+	}
+	return "", 0, false
+}
+
+// markdownLink parses [label](url) or ![alt](url) at i. images become links.
+func markdownLink(s string, i int) (string, string, int, bool) {
+	start := i
+	if s[start] == '!' {
+		start++
+	}
+	depth, labelEnd := 0, -1
+scan:
+	for k := start; k < len(s); k++ {
+		switch s[k] {
+		case '\\':
+			k++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				labelEnd = k
+				break scan
+			}
+		}
+	}
+	if labelEnd == -1 || !strings.HasPrefix(s[labelEnd+1:], "(") {
+		return "", "", 0, false
+	}
+	closing := strings.IndexByte(s[labelEnd+2:], ')')
+	if closing == -1 {
+		return "", "", 0, false
+	}
+	url := strings.TrimSpace(s[labelEnd+2 : labelEnd+2+closing])
+	// drop any title, eg: (https://example.com "example")
+	if space := strings.IndexAny(url, " \t"); space != -1 {
+		url = url[:space]
+	}
+	url = strings.TrimSuffix(strings.TrimPrefix(url, "<"), ">")
+	if url == "" {
+		return "", "", 0, false
+	}
+	return url, s[start+1 : labelEnd], labelEnd + 2 + closing + 1, true
+}
+
+// emphasis parses **bold**, *italic*, their _ forms and ~~strikethrough~~ at
+// i, returning what's inside and slack's marker for it.
+func emphasis(s string, i int) (string, string, int, bool) {
+	delim := s[i : i+1]
+	if i+1 < len(s) && s[i+1] == s[i] {
+		delim = s[i : i+2]
+	}
+	marker, ok := mdEmphasis[delim]
+	if !ok {
+		return "", "", 0, false
+	}
+	start := i + len(delim)
+	if start >= len(s) || isSpaceByte(s[start]) {
+		return "", "", 0, false
+	}
+	// slack only formats whole words, and snake_case isn't emphasis anyway
+	if i > 0 && isWordByte(s[i-1]) {
+		return "", "", 0, false
+	}
+	for j := start + 1; j+len(delim) <= len(s); j++ {
+		if s[j:j+len(delim)] != delim || isSpaceByte(s[j-1]) {
+			continue
+		}
+		end := j + len(delim)
+		if end < len(s) && isWordByte(s[end]) {
+			continue
+		}
+		return s[start:j], marker, end, true
+	}
+	return "", "", 0, false
+}
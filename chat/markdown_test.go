@@ -0,0 +1,66 @@
+package chat
+
+import "testing"
+
+func TestMarkdownToMrkdwn(t *testing.T) {
+	link := func(url, label string) string {
+		return "<" + url + "|" + label + ">"
+	}
+	tests := []struct {
+		name, text, want string
+	}{
+		{"plain", "hello", "hello"},
+		{"escaped", "a & <b>", "a &amp; &lt;b&gt;"},
+
+		// emphasis
+		{"bold", "**bold**", "*bold*"},
+		{"bold underscores", "__bold__", "*bold*"},
+		{"italic", "*italic*", "_italic_"},
+		{"italic underscores", "_italic_", "_italic_"},
+		{"strikethrough", "~~gone~~", "~gone~"},
+		{"nested", "**bold _and italic_**", "*bold _and italic_*"},
+		{"nested strikethrough", "~~**both**~~", "~*both*~"},
+		{"snake_case", "snake_case_name", "snake_case_name"},
+		{"space after opener", "a * not italic*", "a * not italic*"},
+		{"unclosed", "**open", "**open"},
+		{"backslash", `\*not italic\*`, "*not italic*"},
+		{"doesn't cross lines", "*a\nb*", "*a\nb*"},
+
+		// code
+		{"code span", "`a*b*c`", "`a*b*c`"},
+		{"code span escaped", "`<b> & co`", "`&lt;b&gt; &amp; co`"},
+		{"code span in bold", "**use `x`**", "*use `x`*"},
+		{"double backticks", "``a ` b``", "`a ` b`"},
+		{"backticks in code", "`` `a` ``", "``a``"},
+		{"unclosed code", "`a *b*", "`a _b_"},
+		{"code skips links", "`[a](https://example.com)`", "`[a](https://example.com)`"},
+		{"fence", "```go\nif a < b {\n```", "```\nif a &lt; b {\n```"},
+		{"unclosed fence", "~~~\n**x**", "```\n**x**\n```"},
+
+		// links
+		{"link", "[a](https://example.com)", "<https://example.com|a>"},
+		{"link with title", `[a](https://example.com "title")`, "<https://example.com|a>"},
+		{"angle bracket link", "[a](<https://example.com>)", "<https://example.com|a>"},
+		{"image", "![alt](https://example.com/a.png)", "<https://example.com/a.png|alt>"},
+		{"nested brackets", "[[a]](https://example.com)", "<https://example.com|[a]>"},
+		{"not a link", "[a] (b)", "[a] (b)"},
+		// hand-typed slack markup goes to inline whole, for the sanitizer
+		{"control sequence", "<https://example.com|*a*>", "&lt;https://example.com|*a*&gt;"},
+
+		// blocks
+		{"heading", "# Title #", "*Title*"},
+		{"empty heading", "#", ""},
+		{"heading needs a space", "#hashtag", "#hashtag"},
+		{"quote", "> quoted *text*", "&gt; quoted _text_"},
+		{"bullets", "- a\n  * b", "• a\n  • b"},
+		{"numbered", "1) a\n2. b", "1. a\n2. b"},
+		{"rule", "* * *", "───"},
+		{"crlf", "a\r\nb", "a\nb"},
+		{"table", "| a | b |", "| a | b |"},
+	}
+	for _, test := range tests {
+		if got := markdownToMrkdwn(test.text, escapeMrkdwn, link); got != test.want {
+			t.Errorf("%s: markdownToMrkdwn(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
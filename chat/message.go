@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nlopes/slack"
 )
@@ -22,6 +24,12 @@ type teamMessage struct {
 type chatChannel struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
+	// read-write, read-only or post-only; only sent in the welcome payload
+	Mode string `json:"mode,omitempty"`
+	// agents online, and their usernames if we may say; only sent in the
+	// welcome payload, then in agents-online events
+	AgentsOnline int      `json:"agents_online,omitempty"`
+	Agents       []string `json:"agents,omitempty"`
 }
 type chatUser struct {
 	ID       string `json:"id"`
@@ -35,6 +43,53 @@ type chatMessage struct {
 	Text    string       `json:"text"`
 	User    *chatUser    `json:"user"`
 	Channel *chatChannel `json:"channel"`
+
+	// Text with its mentions, links and emoji resolved
+	Segments []chatSegment `json:"segments"`
+
+	// set on thread parents and replies alike; a parent's thread_ts is its own ts
+	ThreadTs     string `json:"thread_ts,omitempty"`
+	ReplyCount   int    `json:"reply_count,omitempty"`
+	ParentUserID string `json:"parent_user_id,omitempty"`
+
+	Edited    bool           `json:"edited,omitempty"`
+	Reactions []chatReaction `json:"reactions,omitempty"`
+
+	// bot messages are often all attachments or blocks. clients should show
+	// blocks instead of Text, which is then only a fallback.
+	Attachments []chatAttachment `json:"attachments,omitempty"`
+	Blocks      []chatBlock      `json:"blocks,omitempty"`
+	File        *chatFile        `json:"file,omitempty"`
+}
+type chatReaction struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+type reactionMessage struct {
+	Type     string       `json:"type"`
+	Ts       string       `json:"ts"`
+	Channel  *chatChannel `json:"channel"`
+	Reaction string       `json:"reaction"`
+	// slack user id of whoever reacted
+	UserID string `json:"user_id"`
+}
+type typingMessage struct {
+	Type    string       `json:"type"`
+	Channel *chatChannel `json:"channel"`
+	User    *chatUser    `json:"user"`
+	// seconds to show it for, unless it's repeated or they post
+	ExpiresIn float64 `json:"expires_in"`
+}
+type agentsOnlineMessage struct {
+	Type    string       `json:"type"`
+	Channel *chatChannel `json:"channel"`
+	Count   int          `json:"count"`
+	Agents  []string     `json:"agents,omitempty"`
+}
+type messageDeletedMessage struct {
+	Type    string       `json:"type"`
+	Ts      string       `json:"ts"`
+	Channel *chatChannel `json:"channel"`
 }
 type authMessage struct {
 	Type    string  `json:"type"`
@@ -42,16 +97,100 @@ type authMessage struct {
 	Warning *string `json:"warning"`
 }
 
+type authErrorMessage struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// whether we went ahead and generated a new identity, per AUTH_FAILURE_POLICY
+	Regenerated bool `json:"regenerated"`
+}
+type messageRejectedMessage struct {
+	Type      string `json:"type"`
+	ChannelID string `json:"channel_id"`
+	Reason    string `json:"reason"`
+}
+type uploadProgressMessage struct {
+	Type     string `json:"type"`
+	UploadID string `json:"upload_id"`
+	// receiving, forwarding, done or failed
+	Stage    string `json:"stage"`
+	Received int64  `json:"received"`
+	// size of the whole request, 0 if unknown
+	Total int64     `json:"total"`
+	File  *chatFile `json:"file,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+type messageWarningMessage struct {
+	Type      string `json:"type"`
+	ChannelID string `json:"channel_id"`
+	Warning   string `json:"warning"`
+}
+type moderationResultMessage struct {
+	Type   string  `json:"type"`
+	Action string  `json:"action"`
+	Target string  `json:"target"`
+	Error  *string `json:"error"`
+}
+type tokenExpiringMessage struct {
+	Type      string `json:"type"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type nickRejectedMessage struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Reason   string `json:"reason"`
+}
+
+type inviteErrorMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
 type ClientMessageAuth struct {
 	Token string
+	// optional invite to redeem for the identity
+	Invite string
 }
 type ClientMessageHistory struct {
 	ChannelID string
 	Limit     int
 }
+type ClientMessageNick struct {
+	Username string
+}
+type ClientMessageModerate struct {
+	Action    string
+	Username  string
+	ChannelID string
+	Ts        string
+}
+type ClientMessageReact struct {
+	ChannelID string
+	Ts        string
+	Reaction  string
+	// take the reaction away instead
+	Remove bool
+}
+type ClientMessageTyping struct {
+	ChannelID string
+}
+type ClientMessageSubscribe struct {
+	ChannelID string
+}
+type ClientMessageUnsubscribe struct {
+	ChannelID string
+}
+type ClientMessageThreadHistory struct {
+	ChannelID string
+	ThreadTs  string
+	Limit     int
+}
 type ClientMessageSend struct {
 	ChannelID string
 	Text      string
+	// optional, to reply in a thread
+	ThreadTs string
 }
 
 func encode(m interface{}) []byte {
@@ -77,7 +216,7 @@ func DecodeClientMessage(c *ClientMessage) (typedMessage interface{}, err error)
 			err = fmt.Errorf("invalid client message received: missing channel_id")
 			return
 		}
-		cms := &ClientMessageSend{ChannelID: channelID, Text: buff["text"]}
+		cms := &ClientMessageSend{ChannelID: channelID, Text: buff["text"], ThreadTs: buff["thread_ts"]}
 		if cms.Text == "" {
 			err = fmt.Errorf("invalid client message received: missing text")
 		} else {
@@ -90,28 +229,101 @@ func DecodeClientMessage(c *ClientMessage) (typedMessage interface{}, err error)
 			return
 		}
 		var limit int
-		if rawLimit := buff["limit"]; rawLimit != "" {
-			limit, err = strconv.Atoi(rawLimit)
-			if err != nil || limit <= 0 || limit > 1000 {
-				err = fmt.Errorf("invalid client message received: limit has incorrect bounds")
-				return
-			}
-		} else {
-			limit = 10
+		limit, err = decodeLimit(buff["limit"], 10)
+		if err != nil {
+			return
 		}
 		typedMessage = &ClientMessageHistory{ChannelID: channelID, Limit: limit}
+	case "thread-history":
+		channelID, threadTs := buff["channel_id"], buff["thread_ts"]
+		if channelID == "" || threadTs == "" {
+			err = fmt.Errorf("invalid client message received: missing channel_id or thread_ts")
+			return
+		}
+		var limit int
+		limit, err = decodeLimit(buff["limit"], 100)
+		if err != nil {
+			return
+		}
+		typedMessage = &ClientMessageThreadHistory{ChannelID: channelID, ThreadTs: threadTs, Limit: limit}
+	case "subscribe", "unsubscribe":
+		channelID := buff["channel_id"]
+		if channelID == "" {
+			err = fmt.Errorf("invalid client message received: missing channel_id")
+			return
+		}
+		if t == "subscribe" {
+			typedMessage = &ClientMessageSubscribe{ChannelID: channelID}
+		} else {
+			typedMessage = &ClientMessageUnsubscribe{ChannelID: channelID}
+		}
+	case "react":
+		cmr := &ClientMessageReact{ChannelID: buff["channel_id"], Ts: buff["ts"], Reaction: strings.Trim(buff["reaction"], ":"), Remove: buff["remove"] == "true"}
+		if cmr.ChannelID == "" || cmr.Ts == "" || cmr.Reaction == "" {
+			err = fmt.Errorf("invalid client message received: missing channel_id, ts or reaction")
+			return
+		}
+		typedMessage = cmr
+	case "typing":
+		channelID := buff["channel_id"]
+		if channelID == "" {
+			err = fmt.Errorf("invalid client message received: missing channel_id")
+			return
+		}
+		typedMessage = &ClientMessageTyping{ChannelID: channelID}
 	case "auth":
-		typedMessage = &ClientMessageAuth{Token: buff["token"]}
+		typedMessage = &ClientMessageAuth{Token: buff["token"], Invite: buff["invite"]}
+	case "moderate":
+		cmm := &ClientMessageModerate{Action: buff["action"], Username: buff["username"], ChannelID: buff["channel_id"], Ts: buff["ts"]}
+		switch cmm.Action {
+		case "ban", "unban":
+			if cmm.Username == "" {
+				err = fmt.Errorf("invalid client message received: missing username")
+				return
+			}
+		case "delete":
+			if cmm.ChannelID == "" || cmm.Ts == "" {
+				err = fmt.Errorf("invalid client message received: missing channel_id or ts")
+				return
+			}
+		default:
+			err = fmt.Errorf("invalid client message received: unknown moderation action %s", cmm.Action)
+			return
+		}
+		typedMessage = cmm
+	case "nick":
+		username := strings.TrimSpace(buff["username"])
+		if username == "" {
+			err = fmt.Errorf("invalid client message received: missing username")
+			return
+		}
+		typedMessage = &ClientMessageNick{Username: username}
 	default:
 		err = fmt.Errorf("unknown message type %s received (%v)", t, buff)
 	}
 	return
 }
-func EncodeWelcomePayload(slackInfo *slack.Info, customEmoji map[string]string, teamInfo *slack.TeamInfo) []byte {
+
+// decodeLimit parses an optional history limit.
+func decodeLimit(rawLimit string, defaultLimit int) (int, error) {
+	if rawLimit == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(rawLimit)
+	if err != nil || limit <= 0 || limit > 1000 {
+		return 0, fmt.Errorf("invalid client message received: limit has incorrect bounds")
+	}
+	return limit, nil
+}
+func EncodeWelcomePayload(slackInfo *slack.Info, customEmoji map[string]string, teamInfo *slack.TeamInfo, visible func(channelID string) bool, mode func(channelID string) string, online func(channelID string) (int, []string)) []byte {
 	channels := []chatChannel{}
 	if slackInfo.Channels != nil {
 		for _, c := range slackInfo.Channels {
-			channels = append(channels, chatChannel{ID: c.ID, Name: c.Name})
+			if !visible(c.ID) {
+				continue
+			}
+			count, agents := online(c.ID)
+			channels = append(channels, chatChannel{ID: c.ID, Name: c.Name, Mode: mode(c.ID), AgentsOnline: count, Agents: agents})
 		}
 	}
 	users := []chatUser{}
@@ -131,12 +343,60 @@ func EncodeWelcomePayload(slackInfo *slack.Info, customEmoji map[string]string,
 	return encode(tm)
 
 }
-func ClientHandlesMessage(ev *slack.Message) bool {
+func ClientHandlesMessage(ev *slack.Message, blocks []chatBlock) bool {
 	// TODO: handle other types :)
-	return ((ev.SubType == "" || ev.SubType == "bot_message") && ev.Text != "" && ev.Timestamp != "")
+	if ev.SubType != "" && ev.SubType != "bot_message" && ev.SubType != "file_share" {
+		return false
+	}
+	return (ev.Text != "" || len(ev.Attachments) != 0 || ev.File != nil || len(blocks) != 0) && ev.Timestamp != ""
 }
-func EncodeMessageEvent(c *slack.Client, m *slack.MessageEvent) []byte {
-	cm := chatMessage{Type: "message", Ts: m.Timestamp, Text: m.Text, Channel: &chatChannel{ID: m.Channel}}
+func EncodeMessageEvent(c *slack.Client, names mentionResolver, m *slack.MessageEvent, blocks []chatBlock) []byte {
+	return encode(newChatMessage(c, names, m, blocks))
+}
+
+// EncodeMessageUpdatedEvent encodes the edited message from a message_changed event,
+// for clients to patch the message with the same channel and ts.
+func EncodeMessageUpdatedEvent(c *slack.Client, names mentionResolver, m *slack.MessageEvent, blocks []chatBlock) []byte {
+	edited := &slack.MessageEvent{Msg: *m.SubMessage}
+	edited.Channel = m.Channel
+	cm := newChatMessage(c, names, edited, blocks)
+	cm.Type = "message-updated"
+	return encode(cm)
+}
+func EncodeReactionEvent(added bool, channelID, ts, reaction, userID string) []byte {
+	t := "reaction-removed"
+	if added {
+		t = "reaction-added"
+	}
+	return encode(reactionMessage{Type: t, Ts: ts, Channel: &chatChannel{ID: channelID}, Reaction: reaction, UserID: userID})
+}
+func EncodeTypingEvent(channelID string, user *chatUser, expiresIn time.Duration) []byte {
+	return encode(typingMessage{Type: "typing", Channel: &chatChannel{ID: channelID}, User: user, ExpiresIn: expiresIn.Seconds()})
+}
+func EncodeAgentsOnlineEvent(channelID string, count int, agents []string) []byte {
+	return encode(agentsOnlineMessage{Type: "agents-online", Channel: &chatChannel{ID: channelID}, Count: count, Agents: agents})
+}
+func EncodeMessageDeletedEvent(channelID, ts string) []byte {
+	return encode(messageDeletedMessage{Type: "message-deleted", Ts: ts, Channel: &chatChannel{ID: channelID}})
+}
+func newChatMessage(c *slack.Client, names mentionResolver, m *slack.MessageEvent, blocks []chatBlock) chatMessage {
+	cm := chatMessage{
+		Type:         "message",
+		Ts:           m.Timestamp,
+		Text:         m.Text,
+		Channel:      &chatChannel{ID: m.Channel},
+		Segments:     tokenizeMrkdwn(m.Text, names),
+		ThreadTs:     m.ThreadTimestamp,
+		ReplyCount:   m.ReplyCount,
+		ParentUserID: m.ParentUserId,
+		Edited:       m.Edited != nil,
+		Attachments:  newChatAttachments(m.Attachments),
+		Blocks:       blocks,
+		File:         newChatFile(m.File),
+	}
+	for _, r := range m.Reactions {
+		cm.Reactions = append(cm.Reactions, chatReaction{Name: r.Name, Count: r.Count})
+	}
 	// TODO ask for users/sigils over the wire
 	if m.SubType == "bot_message" {
 		gravatarURL := fmt.Sprintf("https://www.gravatar.com/avatar/%x?d=retro", md5.Sum([]byte(m.Username)))
@@ -147,8 +407,40 @@ func EncodeMessageEvent(c *slack.Client, m *slack.MessageEvent) []byte {
 			cm.User = &chatUser{Username: u.Name, Avatar: u.Profile.ImageOriginal, ID: u.ID} // TODO cache / prelim prime with user list
 		}
 	}
-	return encode(cm)
+	return cm
 }
 func EncodeAuthMessage(token string, warning *string) []byte {
 	return encode(authMessage{Type: "auth", Token: token, Warning: warning})
 }
+func EncodeTokenExpiringMessage(expiresAt time.Time) []byte {
+	return encode(tokenExpiringMessage{Type: "token-expiring", ExpiresAt: expiresAt.Unix()})
+}
+func EncodeNickRejectedMessage(username, reason string) []byte {
+	return encode(nickRejectedMessage{Type: "nick-rejected", Username: username, Reason: reason})
+}
+func EncodeAuthErrorMessage(reason, message string, regenerated bool) []byte {
+	return encode(authErrorMessage{Type: "auth-error", Reason: reason, Message: message, Regenerated: regenerated})
+}
+func EncodeMessageRejectedMessage(channelID, reason string) []byte {
+	return encode(messageRejectedMessage{Type: "message-rejected", ChannelID: channelID, Reason: reason})
+}
+func EncodeMessageWarningMessage(channelID, warning string) []byte {
+	return encode(messageWarningMessage{Type: "message-warning", ChannelID: channelID, Warning: warning})
+}
+func EncodeModerationResultMessage(action, target string, err error) []byte {
+	var errMessage *string
+	if err != nil {
+		e := err.Error()
+		errMessage = &e
+	}
+	return encode(moderationResultMessage{Type: "moderation-result", Action: action, Target: target, Error: errMessage})
+}
+func EncodeInviteErrorMessage(message string) []byte {
+	return encode(inviteErrorMessage{Type: "invite-error", Message: message})
+}
+func EncodeUploadProgressMessage(uploadID, stage string, received, total int64, file *chatFile, reason string) []byte {
+	if total < 0 {
+		total = 0
+	}
+	return encode(uploadProgressMessage{Type: "upload-progress", UploadID: uploadID, Stage: stage, Received: received, Total: total, File: file, Error: reason})
+}
@@ -0,0 +1,208 @@
+package chat
+
+import (
+	"regexp"
+	"strings"
+)
+
+// chatSegment is a piece of a message's text with slack's markup resolved, so
+// clients don't have to guess at it. Text is always what to show, as plain
+// text: slack's escaping is undone, so clients must never render it as html.
+type chatSegment struct {
+	// text, user, channel, link, special or emoji
+	Type string `json:"type"`
+	Text string `json:"text"`
+	// user, channel or user group id
+	ID string `json:"id,omitempty"`
+	// where a link goes, or a custom emoji's image
+	URL string `json:"url,omitempty"`
+	// the emoji, or which special mention (here, channel, everyone, subteam, ...)
+	Name string `json:"name,omitempty"`
+}
+
+// mentionResolver looks up what slack's markup refers to. it returns "" for
+// anything it doesn't know, or shouldn't tell visitors about.
+type mentionResolver interface {
+	userName(id string) string
+	channelName(id string) string
+	emojiURL(name string) string
+}
+
+var emojiName = regexp.MustCompile(`^[a-z0-9_+'-]+$`)
+
+// slack escapes these, and only these, in message text
+var unescapeMrkdwn = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace
+
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+// tokenizeMrkdwn splits message text into plain text, <...> control sequences
+// (mentions and links) and :emoji:. text formatting like *bold* is left in the
+// text segments.
+func tokenizeMrkdwn(text string, names mentionResolver) []chatSegment {
+	segments := []chatSegment{}
+	start := 0
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '<':
+			end := strings.IndexByte(text[i:], '>')
+			if end == -1 {
+				break
+			}
+			segments = appendText(segments, unescapeMrkdwn(text[start:i]))
+			if s := controlSegment(text[i+1:i+end], names); s.Type == "text" {
+				segments = appendText(segments, s.Text)
+			} else {
+				segments = append(segments, s)
+			}
+			i += end + 1
+			start = i
+			continue
+		case ':':
+			// eg: not the middle of 10:30:00
+			if i > 0 && isWordByte(text[i-1]) {
+				break
+			}
+			end := strings.IndexByte(text[i+1:], ':')
+			if end == -1 {
+				break
+			}
+			name := text[i+1 : i+1+end]
+			after := i + end + 2
+			if !emojiName.MatchString(name) || (after < len(text) && isWordByte(text[after])) {
+				break
+			}
+			segments = appendText(segments, unescapeMrkdwn(text[start:i]))
+			segments = append(segments, chatSegment{Type: "emoji", Text: ":" + name + ":", Name: name, URL: names.emojiURL(name)})
+			i = after
+			start = i
+			continue
+		}
+		i++
+	}
+	return appendText(segments, unescapeMrkdwn(text[start:]))
+}
+
+// appendText adds plain text, merging it with any text before it.
+func appendText(segments []chatSegment, text string) []chatSegment {
+	if text == "" {
+		return segments
+	}
+	if last := len(segments) - 1; last >= 0 && segments[last].Type == "text" {
+		segments[last].Text += text
+		return segments
+	}
+	return append(segments, chatSegment{Type: "text", Text: text})
+}
+
+// controlSegment resolves the inside of a <...> sequence, eg: @U123, #C123|general,
+// !here or https://example.com|a label.
+func controlSegment(body string, names mentionResolver) chatSegment {
+	target, label := body, ""
+	if bar := strings.IndexByte(body, '|'); bar != -1 {
+		target, label = body[:bar], unescapeMrkdwn(body[bar+1:])
+	}
+	target = unescapeMrkdwn(target)
+	if target == "" {
+		return chatSegment{Type: "text", Text: label}
+	}
+	switch target[0] {
+	case '@':
+		id := target[1:]
+		name := names.userName(id)
+		if name == "" {
+			name = strings.TrimPrefix(label, "@")
+		}
+		if name == "" {
+			name = id
+		}
+		return chatSegment{Type: "user", Text: "@" + name, ID: id}
+	case '#':
+		id := target[1:]
+		name := names.channelName(id)
+		if name == "" {
+			name = strings.TrimPrefix(label, "#")
+		}
+		if name == "" {
+			name = id
+		}
+		return chatSegment{Type: "channel", Text: "#" + name, ID: id}
+	case '!':
+		// eg: !here, !subteam^S123|@team or !date^1392734382^{date}|Feb 18, 2014
+		command := target[1:]
+		name, arg := command, ""
+		if caret := strings.IndexByte(command, '^'); caret != -1 {
+			name, arg = command[:caret], command[caret+1:]
+		}
+		switch name {
+		case "here", "channel", "everyone":
+			return chatSegment{Type: "special", Text: "@" + name, Name: name}
+		case "subteam":
+			if label == "" {
+				label = "@" + arg
+			}
+			return chatSegment{Type: "special", Text: label, Name: name, ID: arg}
+		case "date":
+			return chatSegment{Type: "text", Text: label}
+		}
+		if label == "" {
+			label = "@" + name
+		}
+		return chatSegment{Type: "special", Text: label, Name: name}
+	}
+	text := label
+	if text == "" {
+		text = strings.TrimPrefix(target, "mailto:")
+	}
+	u := linkURL(target)
+	if u == "" {
+		return chatSegment{Type: "text", Text: text}
+	}
+	return chatSegment{Type: "link", Text: text, URL: u}
+}
+
+// linkURL is sanitizeURL, plus mailto: links.
+func linkURL(target string) string {
+	if strings.HasPrefix(strings.ToLower(target), "mailto:") && !strings.ContainsAny(target, "\"'<> ") {
+		return target
+	}
+	return sanitizeURL(target)
+}
+
+func (h *Hub) userName(id string) string {
+	if u := h.slackUser(id); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// channelName only knows channels visitors may see.
+func (h *Hub) channelName(id string) string {
+	if h.slackInfo == nil {
+		return ""
+	}
+	for i := range h.slackInfo.Channels {
+		if c := &h.slackInfo.Channels[i]; c.ID == id && h.channels.allows(c) {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+// emojiURL returns a custom emoji's image, following aliases. standard emoji are
+// left to the client.
+func (h *Hub) emojiURL(name string) string {
+	// aliases can't reasonably be nested this deep, but don't loop forever
+	for i := 0; i < 10; i++ {
+		target, ok := h.customEmoji[name]
+		if !ok {
+			return ""
+		}
+		if !strings.HasPrefix(target, "alias:") {
+			return sanitizeURL(target)
+		}
+		name = strings.TrimPrefix(target, "alias:")
+	}
+	return ""
+}
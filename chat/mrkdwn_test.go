@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testNames is a tiny workspace: @alice (U1), #general (C1) and a custom :party:.
+type testNames struct{}
+
+func (testNames) userName(id string) string {
+	if id == "U1" {
+		return "alice"
+	}
+	return ""
+}
+
+func (testNames) userID(name string) string {
+	if strings.EqualFold(name, "alice") {
+		return "U1"
+	}
+	return ""
+}
+
+func (testNames) channelName(id string) string {
+	if id == "C1" {
+		return "general"
+	}
+	return ""
+}
+
+func (testNames) emojiURL(name string) string {
+	if name == "party" {
+		return "https://emoji.example.com/party.png"
+	}
+	return ""
+}
+
+func TestTokenizeMrkdwnIsInert(t *testing.T) {
+	tests := []struct {
+		text string
+		want []chatSegment
+	}{
+		// slack's escaping is undone, so Text must be shown as text
+		{"&lt;img src=x onerror=alert(1)&gt;", []chatSegment{{Type: "text", Text: "<img src=x onerror=alert(1)>"}}},
+		{"&lt;script&gt;alert(1)&lt;/script&gt;", []chatSegment{{Type: "text", Text: "<script>alert(1)</script>"}}},
+		{"<javascript:alert(1)|click>", []chatSegment{{Type: "text", Text: "click"}}},
+		{"<javascript:alert(1)>", []chatSegment{{Type: "text", Text: "javascript:alert(1)"}}},
+		{"<data:text/html,x|y>", []chatSegment{{Type: "text", Text: "y"}}},
+		{"<mailto:a@b.c\" onclick=\"x|mail>", []chatSegment{{Type: "text", Text: "mail"}}},
+		{"<https://example.com|&lt;img onerror=x&gt;>", []chatSegment{{Type: "link", Text: "<img onerror=x>", URL: "https://example.com"}}},
+	}
+	for _, test := range tests {
+		got := tokenizeMrkdwn(test.text, testNames{})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenizeMrkdwn(%q) = %+v, want %+v", test.text, got, test.want)
+		}
+		for _, s := range got {
+			if s.URL != "" && !strings.HasPrefix(s.URL, "https://") && !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "mailto:") {
+				t.Errorf("tokenizeMrkdwn(%q) links to %q", test.text, s.URL)
+			}
+		}
+	}
+}
+
+func TestTokenizeMrkdwn(t *testing.T) {
+	tests := []struct {
+		text string
+		want []chatSegment
+	}{
+		{"", []chatSegment{}},
+		{"a &amp; b &lt;c&gt;", []chatSegment{{Type: "text", Text: "a & b <c>"}}},
+		{"&amp;lt;", []chatSegment{{Type: "text", Text: "&lt;"}}},
+		{"hi <@U1>!", []chatSegment{{Type: "text", Text: "hi "}, {Type: "user", Text: "@alice", ID: "U1"}, {Type: "text", Text: "!"}}},
+		{"<@U9|bob>", []chatSegment{{Type: "user", Text: "@bob", ID: "U9"}}},
+		{"<@U9>", []chatSegment{{Type: "user", Text: "@U9", ID: "U9"}}},
+		{"<#C1>", []chatSegment{{Type: "channel", Text: "#general", ID: "C1"}}},
+		// channels visitors can't see keep only what the message says
+		{"<#C9|secret>", []chatSegment{{Type: "channel", Text: "#secret", ID: "C9"}}},
+		{"<!here>", []chatSegment{{Type: "special", Text: "@here", Name: "here"}}},
+		{"<!subteam^S1|@team>", []chatSegment{{Type: "special", Text: "@team", Name: "subteam", ID: "S1"}}},
+		{"<!date^1392734382^{date}|Feb 18, 2014>", []chatSegment{{Type: "text", Text: "Feb 18, 2014"}}},
+		{"<https://example.com>", []chatSegment{{Type: "link", Text: "https://example.com", URL: "https://example.com"}}},
+		{"<https://example.com?a=1&amp;b=2|a &amp; b>", []chatSegment{{Type: "link", Text: "a & b", URL: "https://example.com?a=1&b=2"}}},
+		{"<mailto:a@example.com>", []chatSegment{{Type: "link", Text: "a@example.com", URL: "mailto:a@example.com"}}},
+		{":party: :wave:", []chatSegment{
+			{Type: "emoji", Text: ":party:", Name: "party", URL: "https://emoji.example.com/party.png"},
+			{Type: "text", Text: " "},
+			{Type: "emoji", Text: ":wave:", Name: "wave"},
+		}},
+		{"at 10:30:00", []chatSegment{{Type: "text", Text: "at 10:30:00"}}},
+		{"a <b", []chatSegment{{Type: "text", Text: "a <b"}}},
+	}
+	for _, test := range tests {
+		if got := tokenizeMrkdwn(test.text, testNames{}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenizeMrkdwn(%q) = %+v, want %+v", test.text, got, test.want)
+		}
+	}
+}
+
+// what visitors type should come back as they typed it, once it's been through slack
+func TestTokenizeMrkdwnRoundTrip(t *testing.T) {
+	policy, err := newOutboundPolicy(nil, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		text, want string
+	}{
+		{"fish & chips", "fish & chips"},
+		{"1 < 2 > 0", "1 < 2 > 0"},
+		{"<b>bold?</b>", "<b>bold?</b>"},
+		{"&lt; &amp; &gt;", "&lt; &amp; &gt;"},
+		{"<javascript:alert(1)>", "<javascript:alert(1)>"},
+		{"@alice at 10:30:00", "@alice at 10:30:00"},
+		{"a :party: b", "a :party: b"},
+		// mentions visitors may not make are posted as plain text
+		{"<!channel> <@U1>", "@channel @alice"},
+	}
+	for _, test := range tests {
+		sanitized, _, err := policy.sanitize(test.text, false, testNames{})
+		if err != nil {
+			t.Errorf("sanitize(%q) failed: %s", test.text, err)
+			continue
+		}
+		var shown []string
+		for _, s := range tokenizeMrkdwn(sanitized, testNames{}) {
+			if s.Type != "text" && s.Type != "emoji" {
+				t.Errorf("%q came back with a %s segment", test.text, s.Type)
+			}
+			shown = append(shown, s.Text)
+		}
+		if got := strings.Join(shown, ""); got != test.want {
+			t.Errorf("%q came back as %q, want %q", test.text, got, test.want)
+		}
+	}
+}
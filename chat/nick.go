@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	minNickLength = 3
+	maxNickLength = 32
+)
+
+var nickCharset = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// validateNick checks a requested display name against our naming rules,
+// returning a human-readable reason when it isn't allowed. availability in
+// the username registry is checked separately when reserving. displayNames are
+// slackUsers' display names by id.
+func validateNick(name string, reserved []string, slackUsers []slack.User, displayNames map[string]string) error {
+	if len(name) < minNickLength || len(name) > maxNickLength {
+		return fmt.Errorf("name must be between %d and %d characters", minNickLength, maxNickLength)
+	}
+	if !nickCharset.MatchString(name) {
+		return fmt.Errorf("name may only contain letters, numbers, '.', '_' and '-'")
+	}
+	for _, r := range reserved {
+		if strings.EqualFold(name, r) {
+			return fmt.Errorf("name %s is reserved", name)
+		}
+	}
+	// don't let visitors impersonate people in the workspace, by any of their names
+	for _, u := range slackUsers {
+		for _, taken := range []string{u.Name, displayNames[u.ID], u.Profile.RealName, u.RealName} {
+			if taken != "" && nickKey(name) == nickKey(taken) {
+				return fmt.Errorf("name %s belongs to a member of this slack", name)
+			}
+		}
+	}
+	return nil
+}
+
+// nickKey is how alike two names look: case and separators don't count, so
+// alice.smith is taken by "Alice Smith".
+func nickKey(name string) string {
+	return strings.ToLower(nickSeparators.Replace(name))
+}
+
+var nickSeparators = strings.NewReplacer(" ", "", ".", "", "_", "", "-", "")
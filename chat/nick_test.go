@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+func TestValidateNick(t *testing.T) {
+	alice := slack.User{ID: "U1", Name: "asmith", RealName: "Alice Smith"}
+	bob := slack.User{ID: "U2", Name: "bjones"}
+	bob.Profile.RealName = "Robert Jones"
+	users := []slack.User{alice, bob}
+	displayNames := map[string]string{"U1": "ally", "U2": "Bobby J"}
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"carol", true},
+		{"ASmith", false},
+		{"Alice.Smith", false},
+		{"ALICE_SMITH", false},
+		{"alice-smith", false},
+		{"Ally", false},
+		{"robert.jones", false},
+		{"bobby_j", false},
+		{"bobby", true},
+		{"admin", false},
+		{"al", false},
+		{"<!here>", false},
+	}
+	for _, test := range tests {
+		err := validateNick(test.name, []string{"admin"}, users, displayNames)
+		if test.ok && err != nil {
+			t.Errorf("%s: refused: %s", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: allowed", test.name)
+		}
+	}
+}
+
+func TestMemberDisplayNames(t *testing.T) {
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		return map[string]interface{}{"ok": true, "members": []map[string]interface{}{
+			{"id": "U1", "name": "asmith", "profile": map[string]string{"display_name": "ally"}},
+			{"id": "U2", "name": "bjones", "profile": map[string]string{"display_name": ""}},
+		}}
+	})
+	defer f.Close()
+	h := &Hub{slackToken: "token"}
+
+	names, err := h.memberDisplayNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names["U1"] != "ally" {
+		t.Errorf("got %v", names)
+	}
+	if calls := f.called("users.list"); len(calls) != 1 || calls[0].Get("token") != "token" {
+		t.Errorf("users.list called with %v", calls)
+	}
+}
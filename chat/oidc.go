@@ -0,0 +1,405 @@
+package chat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/nlopes/slack"
+)
+
+const oidcCookie = "cmss_oidc"
+
+// oidcProvider runs the authorization code flow against an OpenID Connect issuer.
+// discovery and the provider's signing keys are fetched lazily and cached.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+
+	http *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]interface{}
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCProvider(cfg *Config) (*oidcProvider, error) {
+	if cfg.OIDC.Issuer == "" {
+		return nil, nil
+	}
+	if cfg.OIDC.ClientID == "" || cfg.OIDC.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+	}
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(cfg.OIDC.Issuer, "/"),
+		clientID:     cfg.OIDC.ClientID,
+		clientSecret: cfg.OIDC.ClientSecret,
+		redirectURL:  cfg.OIDC.RedirectURL,
+		scopes:       cfg.OIDC.Scopes,
+		http:         &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	res, err := p.http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("discovery failed: %s", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery returned issuer %s, expected %s", d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints: %#v", d)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// providerKey finds the provider's public key for kid, refreshing the key set
+// once if it isn't known (the provider may have rotated). a token without a kid
+// is taken to be signed with the provider's only key; we only go fetching for
+// it before we have any.
+func (p *oidcProvider) providerKey(d *oidcDiscovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.cachedKey(kid); ok {
+		return key, nil
+	}
+	if kid == "" && p.keys != nil {
+		return nil, fmt.Errorf("Provider has %d signing keys, token names none", len(p.keys))
+	}
+	var set jwks
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching provider keys failed: %s", err)
+	}
+	p.keys = map[string]interface{}{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("warn: skipping provider key %s - %s\n", k.Kid, err)
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+	if key, ok := p.cachedKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown provider signing key: %s", kid)
+}
+
+// cachedKey is the known key for kid, or with no kid, the only known key.
+func (p *oidcProvider) cachedKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := jwt.DecodeSegment(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwt.DecodeSegment(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := jwt.DecodeSegment(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwt.DecodeSegment(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// exchange trades an authorization code for the provider's id token.
+func (p *oidcProvider) exchange(d *oidcDiscovery, code string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectURL},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	res, err := p.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token response (%s): %s", res.Status, err)
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token exchange failed (%s): %s", res.Status, body.Error)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the id token signature, issuer, audience, lifetime and nonce,
+// returning the provider's subject and our user mapped from its claims.
+func (p *oidcProvider) verifyIDToken(d *oidcDiscovery, idToken, nonce string) (string, *User, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.providerKey(d, kid)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+		}
+		return key, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+		return "", nil, fmt.Errorf("Unexpected token issuer: %v", claims["iss"])
+	}
+	if !p.audienceMatches(claims["aud"]) {
+		return "", nil, fmt.Errorf("Unexpected token audience: %v", claims["aud"])
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", nil, fmt.Errorf("Token expired or missing exp: %v", claims["exp"])
+	}
+	tokenNonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return "", nil, fmt.Errorf("Unexpected token nonce")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return "", nil, fmt.Errorf("Missing sub claim")
+	}
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username = sub
+	}
+	return sub, &User{Username: username, Verified: true}, nil
+}
+
+func (p *oidcProvider) audienceMatches(aud interface{}) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == p.clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, _ := v.(string); s == p.clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ServeOIDCLogin starts the authorization code flow, remembering state and nonce
+// in a short-lived cookie.
+func ServeOIDCLogin(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	p := hub.oidc
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := p.discover()
+	if err != nil {
+		log.Printf("error: oidc login - %s\n", err)
+		http.Error(w, "login is unavailable", http.StatusBadGateway)
+		return
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "login is unavailable", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "login is unavailable", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+	})
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURL},
+		"scope":         {p.scopes},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// reserveOIDCUsername reserves the username a provider suggested, if it follows
+// our rules like any other and isn't someone else's, or a random one otherwise.
+func (h *Hub) reserveOIDCUsername(preferred, subject string, expiresAt time.Time) (string, error) {
+	var slackUsers []slack.User
+	if h.slackInfo != nil {
+		slackUsers = h.slackInfo.Users
+	}
+	err := validateNick(preferred, h.reservedNames, slackUsers, h.displayNames)
+	if err == nil {
+		err = h.names.reserve(preferred, subject, expiresAt)
+	}
+	if err == nil {
+		return preferred, nil
+	}
+	log.Printf("warn: oidc user %s (%s) can't have their username, generating one - %s\n", preferred, subject, err)
+	return reserveRandomUsername(h.names, subject, expiresAt)
+}
+
+// ServeOIDCCallback completes the flow, issuing one of our own identity tokens
+// for the verified user and handing it to the web client in the url fragment.
+func ServeOIDCCallback(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	p := hub.oidc
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: "", Path: "/", MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("warn: oidc callback returned error %s (%s)\n", e, q.Get("error_description"))
+		http.Error(w, "login was not completed", http.StatusUnauthorized)
+		return
+	}
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "login session expired", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(q.Get("state"))) != 1 {
+		http.Error(w, "login state mismatch", http.StatusBadRequest)
+		return
+	}
+	d, err := p.discover()
+	if err != nil {
+		log.Printf("error: oidc callback - %s\n", err)
+		http.Error(w, "login is unavailable", http.StatusBadGateway)
+		return
+	}
+	idToken, err := p.exchange(d, q.Get("code"))
+	if err != nil {
+		log.Printf("error: oidc callback - %s\n", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	sub, user, err := p.verifyIDToken(d, idToken, parts[1])
+	if err != nil {
+		log.Printf("error: oidc callback, invalid id token - %s\n", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	subject := "oidc|" + sub
+	user.Username, err = hub.reserveOIDCUsername(user.Username, subject, time.Now().Add(hub.tokenTTL))
+	if err != nil {
+		log.Printf("error: oidc user %s has no username - %s\n", subject, err)
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	_, signedToken, err := signUserJWT(hub.keys, &identity{Subject: subject, User: user, Role: RoleVisitor}, hub.tokenTTL)
+	if err != nil {
+		log.Printf("error: failed to sign token for oidc user %s - %s\n", user.Username, err)
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("issuing verified identity %s (%s)\n", user.Username, subject)
+	http.Redirect(w, r, "/#token="+url.QueryEscape(signedToken), http.StatusFound)
+}
@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/nlopes/slack"
+)
+
+func TestReserveOIDCUsername(t *testing.T) {
+	names, err := newUsernameRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Hub{
+		names:         names,
+		reservedNames: []string{"admin"},
+		slackInfo:     &slack.Info{Users: []slack.User{{ID: "U1", Name: "alice"}}},
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	tests := []struct {
+		preferred, subject string
+		keeps              bool
+	}{
+		{"bob", "oidc|1", true},
+		{"bob", "oidc|1", true},
+		{"bob", "oidc|2", false},
+		{"admin", "oidc|3", false},
+		{"Alice", "oidc|4", false},
+		{"<!channel>", "oidc|5", false},
+		{"*bold*", "oidc|6", false},
+		{"auth0|12345", "oidc|7", false},
+	}
+	for _, test := range tests {
+		got, err := h.reserveOIDCUsername(test.preferred, test.subject, expiresAt)
+		if err != nil {
+			t.Fatalf("reserveOIDCUsername(%q): %s", test.preferred, err)
+		}
+		if test.keeps != (got == test.preferred) {
+			t.Errorf("reserveOIDCUsername(%q) = %q, keeps = %v", test.preferred, got, !test.keeps)
+		}
+		if err := validateNick(got, h.reservedNames, h.slackInfo.Users, nil); err != nil && !test.keeps {
+			t.Errorf("reserveOIDCUsername(%q) generated %q: %s", test.preferred, got, err)
+		}
+		if holder := names.holder(got); holder != test.subject {
+			t.Errorf("%q is held by %q, want %q", got, holder, test.subject)
+		}
+	}
+}
+
+func TestUploadCommentEscapesUsername(t *testing.T) {
+	if got, want := uploadComment("<!channel>", ""), "*&lt;!channel&gt;* shared a file"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := uploadComment("a&b", "hi"), "*a&amp;b*: hi"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProviderKeyWithoutKid(t *testing.T) {
+	var set jwks
+	for _, kid := range []string{"k1", "k2"} {
+		priv, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.Keys = append(set.Keys, jwk{Kty: "RSA", Kid: kid, Alg: "RS256", Use: "sig", N: jwt.EncodeSegment(priv.N.Bytes()), E: "AQAB"})
+	}
+	var served jwks
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(served)
+	}))
+	defer server.Close()
+	d := &oidcDiscovery{JWKSURI: server.URL}
+
+	// one key: tokens without a kid use it, fetched once
+	served.Keys = set.Keys[:1]
+	p := &oidcProvider{http: http.DefaultClient}
+	for i := 0; i < 3; i++ {
+		if _, err := p.providerKey(d, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.providerKey(d, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Errorf("fetched %d times, want once", fetches)
+	}
+
+	// a kid we don't know is worth one refetch
+	served.Keys = set.Keys
+	if _, err := p.providerKey(d, "k2"); err != nil || fetches != 2 {
+		t.Errorf("rotated key: %v, fetched %d times", err, fetches)
+	}
+
+	// with more than one key, a token without a kid is refused, without refetching
+	for i := 0; i < 3; i++ {
+		if _, err := p.providerKey(d, ""); err == nil {
+			t.Error("no kid with two keys: allowed")
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("fetched %d times, want twice", fetches)
+	}
+}
@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// visitorPosts remembers who posted each visitor message in post-only channels,
+// by subject. posts go out under the visitor's name, which someone else can
+// claim once its reservation lapses, so the name can't say whose they are.
+// posts are forgotten once they're older than retention (unless it's <= 0),
+// after which not even their author sees them. it's optionally mirrored to a
+// json file.
+type visitorPosts struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+
+	// channel id + "/" + ts -> subject
+	byMessage map[string]string
+
+	// posts still on their way to slack, since the message event can arrive
+	// before chat.postMessage tells us its ts
+	pending []*pendingPost
+}
+type pendingPost struct {
+	channelID string
+	username  string
+	subject   string
+}
+
+func newVisitorPosts(path string, retention time.Duration) (*visitorPosts, error) {
+	p := &visitorPosts{path: path, retention: retention, byMessage: map[string]string{}}
+	if path == "" {
+		return p, nil
+	}
+	if err := loadJSONFile(path, &p.byMessage); err != nil {
+		return nil, err
+	}
+	if p.byMessage == nil {
+		p.byMessage = map[string]string{}
+	}
+	log.Printf("loaded %d visitor posts from %s\n", len(p.byMessage), path)
+	return p, nil
+}
+
+// expect notes a post we're about to send, returning a func to call with its
+// ts once slack has it, or "" if it failed or needn't be remembered.
+func (p *visitorPosts) expect(channelID, username, subject string) func(ts string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	post := &pendingPost{channelID: channelID, username: username, subject: subject}
+	p.pending = append(p.pending, post)
+	return func(ts string) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i := range p.pending {
+			if p.pending[i] == post {
+				p.pending = append(p.pending[:i], p.pending[i+1:]...)
+				break
+			}
+		}
+		if ts == "" {
+			return
+		}
+		p.byMessage[channelID+"/"+ts] = subject
+		p.persist()
+	}
+}
+
+// persist forgets posts past retention and writes the rest out. callers hold mu.
+func (p *visitorPosts) persist() {
+	if p.retention > 0 {
+		oldest := time.Now().Add(-p.retention)
+		for key := range p.byMessage {
+			ts := key[strings.LastIndex(key, "/")+1:]
+			if slackTsTime(ts).Before(oldest) {
+				delete(p.byMessage, key)
+			}
+		}
+	}
+	if p.path == "" {
+		return
+	}
+	if err := saveJSONFile(p.path, p.byMessage); err != nil {
+		log.Printf("error: couldn't save visitor posts to %s - %s\n", p.path, err)
+	}
+}
+
+// slackTsTime is when a message with slack ts was posted; the zero time if ts
+// isn't one.
+func slackTsTime(ts string) time.Time {
+	seconds, err := strconv.ParseInt(strings.SplitN(ts, ".", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// author returns the subject that posted ts, or "" if it wasn't a visitor.
+func (p *visitorPosts) author(channelID, ts string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retention > 0 && slackTsTime(ts).Before(time.Now().Add(-p.retention)) {
+		return ""
+	}
+	return p.byMessage[channelID+"/"+ts]
+}
+
+// pendingAuthor returns the subject of a post under username we're still
+// waiting to hear back from slack about.
+func (p *visitorPosts) pendingAuthor(channelID, username string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, post := range p.pending {
+		if post.channelID == channelID && post.username == username {
+			return post.subject
+		}
+	}
+	return ""
+}
+
+// postedBy returns the subject of the visitor who posted a message, if any. our
+// posts go out as bot messages under the visitor's name, and their uploads are
+// attributed to them the same way (see attributeUpload).
+func (h *Hub) postedBy(channelID string, m *slack.Message) string {
+	if subject := h.posts.author(channelID, m.Timestamp); subject != "" {
+		return subject
+	}
+	if m.SubType != "bot_message" || m.Username == "" {
+		return ""
+	}
+	if m.File != nil {
+		if by := h.uploads.uploader(m.File.ID); by != nil {
+			return by.Subject
+		}
+	}
+	return h.posts.pendingAuthor(channelID, m.Username)
+}
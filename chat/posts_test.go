@@ -0,0 +1,95 @@
+package chat
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// a visitor's name can be claimed by someone else once its reservation lapses;
+// the new holder mustn't see the old one's posts in a post-only channel
+func TestPostOnlyVisibilityFollowsSubject(t *testing.T) {
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		return map[string]interface{}{"ok": true, "messages": []map[string]interface{}{
+			{"type": "message", "subtype": "bot_message", "username": "bob", "text": "new bob", "ts": "1.2"},
+			{"type": "message", "subtype": "bot_message", "username": "bob", "text": "old bob", "ts": "1.1"},
+		}}
+	})
+	defer f.Close()
+	feedback := slack.Channel{}
+	feedback.ID, feedback.Name = "C1", "feedback"
+	channels, err := newChannelFilter(nil, nil, map[string]string{"feedback": ChannelPostOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts, _ := newVisitorPosts("", 0)
+	uploads, _ := newVisitorUploads("")
+	h := &Hub{
+		slack:     slack.New("token"),
+		slackInfo: &slack.Info{User: &slack.UserDetails{ID: "UME"}, Channels: []slack.Channel{feedback}},
+		channels:  channels,
+		posts:     posts,
+		uploads:   uploads,
+	}
+	client := func(subject string) *Client {
+		user := &User{Username: "bob"}
+		return &Client{User: user, identity: &identity{Subject: subject, User: user, Role: RoleVisitor}}
+	}
+	oldBob, newBob := client("anon|old"), client("anon|new")
+
+	message := &slack.Message{Msg: slack.Msg{SubType: "bot_message", Username: "bob", Timestamp: "1.1"}}
+	// it can arrive before chat.postMessage returns
+	posted := h.posts.expect("C1", "bob", "anon|old")
+	for _, when := range []string{"pending", "posted"} {
+		b := h.routeBroadcast("C1", message, []byte("{}"))
+		if !h.canSee(oldBob, b) {
+			t.Errorf("%s: its author can't see it", when)
+		}
+		if h.canSee(newBob, b) {
+			t.Errorf("%s: the name's new holder can see it", when)
+		}
+		posted("1.1")
+	}
+	h.posts.expect("C1", "bob", "anon|new")("1.2")
+
+	for _, test := range []struct {
+		c    *Client
+		want string
+	}{{oldBob, "old bob"}, {newBob, "new bob"}} {
+		history := h.previousMessages("C1", 10, &test.c.identity.Subject)
+		if len(history) != 1 || !strings.Contains(string(history[0]), test.want) {
+			t.Errorf("history for %s = %q, want just %q", test.c.identity.Subject, history, test.want)
+		}
+	}
+}
+
+func TestVisitorPostsRetention(t *testing.T) {
+	ts := func(age time.Duration) string {
+		return fmt.Sprintf("%d.000100", time.Now().Add(-age).Unix())
+	}
+	old, recent := ts(2*time.Hour), ts(time.Minute)
+
+	posts, _ := newVisitorPosts("", time.Hour)
+	posts.expect("C1", "bob", "anon|old")(old)
+	if subject := posts.author("C1", old); subject != "" {
+		t.Errorf("post older than retention is by %q", subject)
+	}
+	posts.expect("C1", "bob", "anon|new")(recent)
+	if subject := posts.author("C1", recent); subject != "anon|new" {
+		t.Errorf("recent post is by %q", subject)
+	}
+	if len(posts.byMessage) != 1 {
+		t.Errorf("remembering %v, want only the recent post", posts.byMessage)
+	}
+
+	forever, _ := newVisitorPosts("", 0)
+	forever.expect("C1", "bob", "anon|old")(old)
+	forever.expect("C1", "bob", "anon|new")(recent)
+	if subject := forever.author("C1", old); subject != "anon|old" || len(forever.byMessage) != 2 {
+		t.Errorf("without retention, old post is by %q, remembering %v", subject, forever.byMessage)
+	}
+}
@@ -0,0 +1,180 @@
+package chat
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// agentPresence tracks which of the workspace's people are online and which
+// channels they're in, so visitors can tell whether anyone is around to answer.
+// channel membership is what slack sent as we connected; our slack client
+// doesn't decode member_joined_channel.
+type agentPresence struct {
+	mu sync.Mutex
+	// channel id -> its members, people and bots alike
+	members map[string][]string
+	// user id -> username, for the people who are online
+	online map[string]string
+}
+
+func newAgentPresence() *agentPresence {
+	return &agentPresence{members: map[string][]string{}, online: map[string]string{}}
+}
+
+// users.getPresence allows about 50 calls a minute
+const presencePollGap = 1500 * time.Millisecond
+
+// isAgent is whether u is a person who could answer visitors, rather than a bot
+// or the account we post as.
+func isAgent(info *slack.Info, u *slack.User) bool {
+	return !u.IsBot && !u.Deleted && u.ID != "USLACKBOT" && (info.User == nil || u.ID != info.User.ID)
+}
+
+// load replaces everything with what slack sent as we connected.
+func (p *agentPresence) load(info *slack.Info) {
+	members := map[string][]string{}
+	for _, c := range info.Channels {
+		members[c.ID] = c.Members
+	}
+	online := map[string]string{}
+	for i := range info.Users {
+		if u := &info.Users[i]; isAgent(info, u) && u.Presence == "active" {
+			online[u.ID] = u.Name
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.members, p.online = members, online
+}
+
+// set records an agent going online or away, returning the channels they're in
+// if that changed anything.
+func (p *agentPresence) set(userID, username string, active bool) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.online[userID]; ok == active {
+		return nil
+	}
+	if active {
+		p.online[userID] = username
+	} else {
+		delete(p.online, userID)
+	}
+	channels := []string{}
+	for channelID, members := range p.members {
+		if containsString(members, userID) {
+			channels = append(channels, channelID)
+		}
+	}
+	return channels
+}
+
+// agents returns the members of the given channels that isAgent accepts,
+// online or not.
+func (p *agentPresence) agents(channelIDs []string, isAgent func(userID string) bool) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	agents := []string{}
+	for _, channelID := range channelIDs {
+		for _, userID := range p.members[channelID] {
+			if !containsString(agents, userID) && isAgent(userID) {
+				agents = append(agents, userID)
+			}
+		}
+	}
+	return agents
+}
+
+// inChannel returns the usernames of the agents online in a channel.
+func (p *agentPresence) inChannel(channelID string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := []string{}
+	for _, userID := range p.members[channelID] {
+		if name, ok := p.online[userID]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// agentsOnline is how many agents are online in a channel, and who they are
+// if we may say.
+func (h *Hub) agentsOnline(channelID string) (int, []string) {
+	names := h.presence.inChannel(channelID)
+	if !h.showAgentNames {
+		return len(names), nil
+	}
+	return len(names), names
+}
+
+// presenceChanged records an agent going online or away, pushing the new
+// agents-online counts of their channels to the clients that can see them.
+func (h *Hub) presenceChanged(ev *slack.PresenceChangeEvent) {
+	u := h.slackUser(ev.User)
+	if u == nil || !isAgent(h.slackInfo, u) {
+		return
+	}
+	for _, channelID := range h.presence.set(u.ID, u.Name, ev.Presence == "active") {
+		h.pushAgentsOnline(channelID)
+	}
+}
+
+func (h *Hub) pushAgentsOnline(channelID string) {
+	if !h.channelVisible(channelID) {
+		return
+	}
+	count, names := h.agentsOnline(channelID)
+	if h.logMessages {
+		log.Printf("presence %s: %d agents online\n", channelID, count)
+	}
+	h.sendWhere(func(c *Client) bool {
+		return h.canAccess(c.identity, channelID)
+	}, EncodeAgentsOnlineEvent(channelID, count, names))
+}
+
+// pollPresence keeps agents' presence current. slack only sends presence_change
+// for users a connection subscribes to with presence_sub, which our rtm client
+// can't send, so we ask after each agent in a visible channel in turn, slowly
+// enough to stay under users.getPresence's rate limit. a negative interval
+// turns it off.
+func (h *Hub) pollPresence(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		for _, userID := range h.visibleAgents() {
+			time.Sleep(presencePollGap)
+			h.pollAgent(userID)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// visibleAgents returns the agents in channels visitors can see.
+func (h *Hub) visibleAgents() []string {
+	channels := []string{}
+	for _, c := range h.slackInfo.Channels {
+		if h.channelVisible(c.ID) {
+			channels = append(channels, c.ID)
+		}
+	}
+	return h.presence.agents(channels, func(userID string) bool {
+		u := h.slackUser(userID)
+		return u != nil && isAgent(h.slackInfo, u)
+	})
+}
+
+func (h *Hub) pollAgent(userID string) {
+	presence, err := h.slack.GetUserPresence(userID)
+	if err != nil {
+		log.Printf("error: couldn't get presence of %s: %s\n", userID, err)
+		return
+	}
+	h.presenceChanged(&slack.PresenceChangeEvent{Type: "presence_change", User: userID, Presence: presence.Presence})
+}
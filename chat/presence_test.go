@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// newPresenceHub is a hub for a workspace where alice is online and bob away,
+// both in #support, with a bot, our own user and carol in #internal, which
+// visitors can't see. the client it returns is connected.
+func newPresenceHub(t *testing.T) (*Hub, *Client) {
+	info := &slack.Info{User: &slack.UserDetails{ID: "UME"}}
+	info.Users = []slack.User{
+		{ID: "UA", Name: "alice", Presence: "active"},
+		{ID: "UB", Name: "bob", Presence: "away"},
+		{ID: "UC", Name: "carol", Presence: "away"},
+		{ID: "UBOT", Name: "bot", IsBot: true, Presence: "active"},
+		{ID: "UME", Name: "me", Presence: "active"},
+	}
+	support, internal := slack.Channel{}, slack.Channel{}
+	support.ID, support.Name, support.Members = "C1", "support", []string{"UA", "UB", "UBOT", "UME"}
+	internal.ID, internal.Name, internal.Members = "C2", "internal", []string{"UA", "UC"}
+	info.Channels = []slack.Channel{support, internal}
+
+	channels, err := newChannelFilter(nil, []string{"internal"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Hub{
+		slack:     slack.New("token"),
+		slackInfo: info,
+		channels:  channels,
+		presence:  newAgentPresence(),
+		exec:      make(chan func()),
+		clients:   map[*Client]bool{},
+	}
+	h.presence.load(info)
+	c := &Client{hub: h, send: make(chan []byte, 10)}
+	h.clients[c] = true
+	go func() {
+		for f := range h.exec {
+			f()
+		}
+	}()
+	return h, c
+}
+
+func expectAgentsOnline(t *testing.T, c *Client, want agentsOnlineMessage) {
+	select {
+	case payload := <-c.send:
+		var got agentsOnlineMessage
+		if err := json.Unmarshal(payload, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no agents-online event, want %+v", want)
+	}
+}
+
+func expectNothing(t *testing.T, c *Client) {
+	select {
+	case payload := <-c.send:
+		t.Errorf("unexpected event %s", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPresenceChangeBroadcastsCount(t *testing.T) {
+	h, c := newPresenceHub(t)
+	defer close(h.exec)
+	if count, names := h.agentsOnline("C1"); count != 1 || names != nil {
+		t.Errorf("agentsOnline = %d, %v; want 1 unnamed", count, names)
+	}
+
+	h.presenceChanged(&slack.PresenceChangeEvent{User: "UB", Presence: "active"})
+	expectAgentsOnline(t, c, agentsOnlineMessage{Type: "agents-online", Channel: &chatChannel{ID: "C1"}, Count: 2})
+
+	// nothing changed, bots and our own user aren't agents, and #internal is hidden
+	h.presenceChanged(&slack.PresenceChangeEvent{User: "UB", Presence: "active"})
+	h.presenceChanged(&slack.PresenceChangeEvent{User: "UBOT", Presence: "away"})
+	h.presenceChanged(&slack.PresenceChangeEvent{User: "UME", Presence: "away"})
+	h.presenceChanged(&slack.PresenceChangeEvent{User: "UC", Presence: "active"})
+	expectNothing(t, c)
+
+	h.showAgentNames = true
+	h.presenceChanged(&slack.PresenceChangeEvent{User: "UA", Presence: "away"})
+	expectAgentsOnline(t, c, agentsOnlineMessage{Type: "agents-online", Channel: &chatChannel{ID: "C1"}, Count: 1, Agents: []string{"bob"}})
+}
+
+func TestPollPresenceBroadcastsCount(t *testing.T) {
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		if method != "users.getPresence" {
+			t.Errorf("unexpected call to %s", method)
+			return nil
+		}
+		return map[string]interface{}{"ok": true, "presence": "active"}
+	})
+	defer f.Close()
+	h, c := newPresenceHub(t)
+	defer close(h.exec)
+
+	agents := h.visibleAgents()
+	if !reflect.DeepEqual(agents, []string{"UA", "UB"}) {
+		t.Fatalf("visibleAgents = %v, want [UA UB]", agents)
+	}
+	for _, userID := range agents {
+		h.pollAgent(userID)
+	}
+	expectAgentsOnline(t, c, agentsOnlineMessage{Type: "agents-online", Channel: &chatChannel{ID: "C1"}, Count: 2})
+	expectNothing(t, c)
+	if polled := f.called("users.getPresence"); len(polled) != 2 || polled[1].Get("user") != "UB" {
+		t.Errorf("polled %v", polled)
+	}
+}
@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// forget idle buckets once we're tracking this many keys
+const maxRateLimitKeys = 10000
+
+// rateLimiter is a token bucket per key (usually an identity's subject),
+// refilling one token every interval up to burst. a nil limiter allows everything.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    float64
+	buckets  map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	if interval <= 0 || burst <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: interval, burst: float64(burst), buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from key's bucket, reporting whether there was one.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitKeys {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(l.interval)
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops buckets that have refilled completely; they're no different from new ones.
+// callers hold mu.
+func (l *rateLimiter) prune(now time.Time) {
+	full := time.Duration(l.burst) * l.interval
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUsernameTaken = errors.New("username is held by another identity")
+
+// reservation ties a username to the token subject holding it until the
+// subject's token expires.
+type reservation struct {
+	Username  string    `json:"username"`
+	Subject   string    `json:"subject"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// usernameRegistry keeps usernames unique across live identities. it lives in
+// memory and is optionally mirrored to a json file so restarts don't free names.
+type usernameRegistry struct {
+	mu   sync.Mutex
+	path string
+
+	byName    map[string]*reservation // lower-cased username -> reservation
+	bySubject map[string]*reservation
+}
+
+func newUsernameRegistry(path string) (*usernameRegistry, error) {
+	r := &usernameRegistry{
+		path:      path,
+		byName:    map[string]*reservation{},
+		bySubject: map[string]*reservation{},
+	}
+	if path == "" {
+		return r, nil
+	}
+	var stored []*reservation
+	if err := loadJSONFile(path, &stored); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, res := range stored {
+		if res.ExpiresAt.After(now) {
+			r.byName[strings.ToLower(res.Username)] = res
+			r.bySubject[res.Subject] = res
+		}
+	}
+	log.Printf("loaded %d username reservations from %s\n", len(r.byName), path)
+	return r, nil
+}
+
+// reserve claims username for subject until expiresAt, releasing any other name
+// the subject held. it fails if a different, unexpired subject holds the name.
+func (r *usernameRegistry) reserve(username, subject string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := strings.ToLower(username)
+	if held, ok := r.byName[key]; ok && held.Subject != subject && held.ExpiresAt.After(time.Now()) {
+		return errUsernameTaken
+	}
+	// once it expired, someone else may have taken the subject's old name
+	if prev, ok := r.bySubject[subject]; ok && r.byName[strings.ToLower(prev.Username)] == prev {
+		delete(r.byName, strings.ToLower(prev.Username))
+	}
+	res := &reservation{Username: username, Subject: subject, ExpiresAt: expiresAt}
+	r.byName[key] = res
+	r.bySubject[subject] = res
+	r.persist()
+	return nil
+}
+
+// holder returns the subject currently holding username, if any.
+func (r *usernameRegistry) holder(username string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if held, ok := r.byName[strings.ToLower(username)]; ok && held.ExpiresAt.After(time.Now()) {
+		return held.Subject
+	}
+	return ""
+}
+
+// persist prunes expired reservations and writes the rest out. callers hold mu.
+func (r *usernameRegistry) persist() {
+	now := time.Now()
+	for key, res := range r.byName {
+		if !res.ExpiresAt.After(now) {
+			delete(r.byName, key)
+		}
+	}
+	// a subject's name may have been taken over after it expired, leaving it
+	// only here
+	for subject, res := range r.bySubject {
+		if !res.ExpiresAt.After(now) {
+			delete(r.bySubject, subject)
+		}
+	}
+	if r.path == "" {
+		return
+	}
+	stored := make([]*reservation, 0, len(r.byName))
+	for _, res := range r.byName {
+		stored = append(stored, res)
+	}
+	if err := saveJSONFile(r.path, stored); err != nil {
+		log.Printf("error: couldn't save username reservations to %s - %s\n", r.path, err)
+	}
+}
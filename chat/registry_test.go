@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsernameRegistry(t *testing.T) {
+	r, _ := newUsernameRegistry("")
+	now := time.Now()
+	soon, later := now.Add(time.Millisecond), now.Add(time.Hour)
+
+	if err := r.reserve("alice", "oidc|a", soon); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reserve("Alice", "anon|b", later); err != errUsernameTaken {
+		t.Fatalf("took a held name, got %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// once a's reservation lapses, b can take the name, and a moving on to
+	// another name mustn't free it
+	if err := r.reserve("Alice", "anon|b", later); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reserve("carol", "oidc|a", later); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"alice": "anon|b", "ALICE": "anon|b", "carol": "oidc|a", "bob": ""} {
+		if got := r.holder(name); got != want {
+			t.Errorf("holder(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if err := r.reserve("alice", "anon|c", later); err != errUsernameTaken {
+		t.Errorf("took b's live name, got %v", err)
+	}
+
+	// renaming frees the old name
+	if err := r.reserve("bob", "anon|b", later); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.holder("alice"); got != "" {
+		t.Errorf("alice still held by %q after b renamed", got)
+	}
+}
+
+func TestUsernameRegistryPrunes(t *testing.T) {
+	r, _ := newUsernameRegistry("")
+	r.reserve("alice", "oidc|a", time.Now().Add(time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	r.reserve("alice", "anon|b", time.Now().Add(time.Hour))
+	r.reserve("dave", "anon|d", time.Now().Add(time.Hour))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.bySubject["oidc|a"]; ok {
+		t.Errorf("kept the expired reservation of a subject whose name was taken")
+	}
+	if len(r.byName) != 2 || len(r.bySubject) != 2 {
+		t.Errorf("got %d names and %d subjects, want 2 of each", len(r.byName), len(r.bySubject))
+	}
+}
@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revocations tracks individually revoked tokens (by jti) and banned identities
+// (by username and by the subject that held it, so a name change doesn't escape
+// the ban). it's optionally mirrored to a json file.
+type revocations struct {
+	mu   sync.Mutex
+	path string
+
+	// jti -> when the token would have expired anyway, after which we forget it
+	Tokens map[string]time.Time `json:"tokens"`
+	// lower-cased username or subject -> when it was banned
+	Usernames map[string]time.Time `json:"usernames"`
+	Subjects  map[string]time.Time `json:"subjects"`
+}
+
+func newRevocations(path string) (*revocations, error) {
+	r := &revocations{
+		path:      path,
+		Tokens:    map[string]time.Time{},
+		Usernames: map[string]time.Time{},
+		Subjects:  map[string]time.Time{},
+	}
+	if path == "" {
+		return r, nil
+	}
+	if err := loadJSONFile(path, r); err != nil {
+		return nil, err
+	}
+	// tolerate hand-edited files with missing sections
+	if r.Tokens == nil {
+		r.Tokens = map[string]time.Time{}
+	}
+	if r.Usernames == nil {
+		r.Usernames = map[string]time.Time{}
+	}
+	if r.Subjects == nil {
+		r.Subjects = map[string]time.Time{}
+	}
+	log.Printf("loaded %d revoked tokens and %d banned usernames from %s\n", len(r.Tokens), len(r.Usernames), path)
+	return r, nil
+}
+
+// isRevoked reports whether an identity, or the particular token vouching for it, was revoked.
+func (r *revocations) isRevoked(id *identity) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.Tokens[id.TokenID]; ok && id.TokenID != "" {
+		return true
+	}
+	if _, ok := r.Subjects[id.Subject]; ok {
+		return true
+	}
+	_, ok := r.Usernames[strings.ToLower(id.User.Username)]
+	return ok
+}
+
+func (r *revocations) revokeToken(jti string, expiresAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Tokens[jti] = expiresAt
+	r.persist()
+}
+
+// banUsername revokes every token for username, along with the subject currently
+// holding it, if any.
+func (r *revocations) banUsername(username, subject string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.Usernames[strings.ToLower(username)] = now
+	if subject != "" {
+		r.Subjects[subject] = now
+	}
+	r.persist()
+}
+
+// unbanUsername lifts a ban, returning whether there was one.
+func (r *revocations) unbanUsername(username, subject string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := strings.ToLower(username)
+	_, ok := r.Usernames[key]
+	delete(r.Usernames, key)
+	delete(r.Subjects, subject)
+	r.persist()
+	return ok
+}
+
+// persist forgets revoked tokens that have expired anyway and writes the rest out.
+// callers hold mu.
+func (r *revocations) persist() {
+	now := time.Now()
+	for jti, expiresAt := range r.Tokens {
+		if expiresAt.Before(now) {
+			delete(r.Tokens, jti)
+		}
+	}
+	if r.path == "" {
+		return
+	}
+	if err := saveJSONFile(r.path, r); err != nil {
+		log.Printf("error: couldn't save revocations to %s - %s\n", r.path, err)
+	}
+}
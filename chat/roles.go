@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"log"
+	"sync"
+)
+
+// roles signed into identity tokens, from least to most privileged
+const (
+	RoleVisitor   = "visitor"
+	RoleTrusted   = "trusted"   // skips anti-spam checks
+	RoleModerator = "moderator" // also skips anti-spam, and may moderate from the web client
+)
+
+func validRole(role string) bool {
+	return role == RoleVisitor || role == RoleTrusted || role == RoleModerator
+}
+
+// roleGrants records roles an admin assigned to token subjects. a grant is
+// authoritative over the role in a token, so demotions stick too.
+type roleGrants struct {
+	mu   sync.Mutex
+	path string
+
+	bySubject map[string]string
+}
+
+func newRoleGrants(path string) (*roleGrants, error) {
+	g := &roleGrants{path: path, bySubject: map[string]string{}}
+	if path == "" {
+		return g, nil
+	}
+	if err := loadJSONFile(path, &g.bySubject); err != nil {
+		return nil, err
+	}
+	if g.bySubject == nil {
+		g.bySubject = map[string]string{}
+	}
+	log.Printf("loaded %d role grants from %s\n", len(g.bySubject), path)
+	return g, nil
+}
+
+// roleFor returns the granted role for subject, if an admin assigned one.
+func (g *roleGrants) roleFor(subject string) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	role, ok := g.bySubject[subject]
+	return role, ok
+}
+
+func (g *roleGrants) grant(subject, role string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.bySubject[subject] = role
+	if g.path == "" {
+		return
+	}
+	if err := saveJSONFile(g.path, g.bySubject); err != nil {
+		log.Printf("error: couldn't save role grants to %s - %s\n", g.path, err)
+	}
+}
@@ -0,0 +1,208 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// mentions that notify a whole channel or group
+var broadcastMentions = []string{"here", "channel", "everyone", "subteam"}
+
+var errTooManyLinks = errors.New("your message has too many links")
+
+// what visitors are warned about when their text was changed
+const (
+	warnBroadcast   = "broadcast mentions aren't allowed"
+	warnUserMention = "mentioning people isn't allowed"
+)
+
+// slack control sequences, eg: <!here> or <https://example.com|a link>
+var controlSequence = regexp.MustCompile(`<([^<>]*)>`)
+
+// what visitors type to mention someone, eg: @here or @bob
+var atMention = regexp.MustCompile(`(^|[^\w@.-])@([\w.-]+)`)
+
+var bareURL = regexp.MustCompile(`(?i)\bhttps?://`)
+
+// escapes text so slack shows it as typed
+var escapeMrkdwn = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+// mentionLookup finds workspace users by id and by name.
+type mentionLookup interface {
+	userName(id string) string
+	userID(name string) string
+}
+
+// outboundPolicy decides what visitors' messages may do in slack.
+type outboundPolicy struct {
+	broadcasts   []string
+	userMentions bool
+	maxLinks     int
+}
+
+func newOutboundPolicy(broadcasts []string, userMentions bool, maxLinks int) (*outboundPolicy, error) {
+	p := &outboundPolicy{userMentions: userMentions, maxLinks: maxLinks}
+	for _, b := range broadcasts {
+		b = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(b), "@"))
+		if b == "" {
+			continue
+		}
+		if !containsString(broadcastMentions, b) {
+			return nil, fmt.Errorf("unknown broadcast mention %s", b)
+		}
+		p.broadcasts = append(p.broadcasts, b)
+	}
+	return p, nil
+}
+
+// sanitize turns a visitor's text into what we post to slack. their markdown is
+// converted to slack's formatting (see markdownToMrkdwn), and the rest is
+// escaped so it shows as typed, except for the mentions they may make and
+// links, which are kept as slack markup; mentions they may not make are turned
+// into plain text. exempt clients (moderators) may mention anyone. it returns
+// what was changed, to warn them, or an error if the message can't be sent at all.
+func (p *outboundPolicy) sanitize(text string, exempt bool, names mentionLookup) (string, []string, error) {
+	s := &sanitizer{policy: p, exempt: exempt, names: names, changed: map[string]bool{}}
+	out := markdownToMrkdwn(text, s.inline, s.link)
+	if p.maxLinks > 0 && s.links > p.maxLinks && !exempt {
+		return "", nil, errTooManyLinks
+	}
+	warnings := []string{}
+	for _, reason := range []string{warnBroadcast, warnUserMention} {
+		if s.changed[reason] {
+			warnings = append(warnings, reason)
+		}
+	}
+	return out, warnings, nil
+}
+
+// sanitizer is what sanitizing one message has found so far.
+type sanitizer struct {
+	policy *outboundPolicy
+	exempt bool
+	names  mentionLookup
+
+	links   int
+	changed map[string]bool
+}
+
+// inline sanitizes text outside of code and links.
+func (s *sanitizer) inline(text string) string {
+	var out []string
+	last := 0
+	for _, loc := range controlSequence.FindAllStringSubmatchIndex(text, -1) {
+		out = append(out, s.plainText(text[last:loc[0]]))
+		last = loc[1]
+		sequence, reason := s.controlSequence(text[loc[2]:loc[3]])
+		if reason != "" {
+			s.changed[reason] = true
+		}
+		if sequence == "" {
+			// not something slack would understand; show it as typed
+			sequence = escapeMrkdwn(text[loc[0]:loc[1]])
+		}
+		out = append(out, sequence)
+	}
+	out = append(out, s.plainText(text[last:]))
+	return strings.Join(out, "")
+}
+
+// link makes a markdown link into a slack one, if it goes somewhere we'd link to.
+func (s *sanitizer) link(url, label string) string {
+	if linkURL(url) == "" {
+		return s.inline(fmt.Sprintf("[%s](%s)", label, url))
+	}
+	s.links++
+	if label == "" {
+		return "<" + escapeMrkdwn(url) + ">"
+	}
+	return "<" + escapeMrkdwn(url) + "|" + escapeMrkdwn(label) + ">"
+}
+
+// controlSequence checks slack markup a visitor typed by hand, returning what to
+// post instead and why it was changed, if it was. "" means it isn't markup.
+func (s *sanitizer) controlSequence(body string) (string, string) {
+	target, label := body, ""
+	if bar := strings.IndexByte(body, '|'); bar != -1 {
+		target, label = body[:bar], body[bar+1:]
+	}
+	if target == "" {
+		return "", ""
+	}
+	switch target[0] {
+	case '!':
+		name := target[1:]
+		if caret := strings.IndexByte(name, '^'); caret != -1 {
+			name = name[:caret]
+		}
+		if !containsString(broadcastMentions, name) {
+			return "", ""
+		}
+		if s.exempt || containsString(s.policy.broadcasts, name) {
+			return "<" + escapeMrkdwn(body) + ">", ""
+		}
+		if label == "" {
+			label = "@" + name
+		}
+		return escapeMrkdwn(label), warnBroadcast
+	case '@':
+		if s.exempt || s.policy.userMentions {
+			return "<" + escapeMrkdwn(body) + ">", ""
+		}
+		name := s.names.userName(target[1:])
+		if name == "" {
+			name = strings.TrimPrefix(label, "@")
+		}
+		if name == "" {
+			name = target[1:]
+		}
+		return escapeMrkdwn("@" + name), warnUserMention
+	case '#':
+		// links to a channel, it doesn't notify anyone
+		return "<" + escapeMrkdwn(body) + ">", ""
+	}
+	if linkURL(target) == "" {
+		return "", ""
+	}
+	s.links++
+	return "<" + escapeMrkdwn(body) + ">", ""
+}
+
+// plainText escapes text between control sequences, turning @mentions the
+// visitor may make into slack's markup and counting links slack will make.
+func (s *sanitizer) plainText(text string) string {
+	s.links += len(bareURL.FindAllString(text, -1))
+	return atMention.ReplaceAllStringFunc(escapeMrkdwn(text), func(match string) string {
+		at := strings.IndexByte(match, '@')
+		prefix, name := match[:at], match[at+1:]
+		lower := strings.ToLower(name)
+		if containsString(broadcastMentions, lower) && lower != "subteam" {
+			if s.exempt || containsString(s.policy.broadcasts, lower) {
+				return prefix + "<!" + lower + ">"
+			}
+			// plain @here doesn't notify anyone
+			return match
+		}
+		if s.exempt || s.policy.userMentions {
+			if id := s.names.userID(name); id != "" {
+				return prefix + "<@" + id + ">"
+			}
+		}
+		return match
+	})
+}
+
+// userID finds a workspace user by name.
+func (h *Hub) userID(name string) string {
+	if h.slackInfo == nil {
+		return ""
+	}
+	for i := range h.slackInfo.Users {
+		if u := &h.slackInfo.Users[i]; strings.EqualFold(u.Name, name) && !u.Deleted {
+			return u.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	policy, err := newOutboundPolicy([]string{"@here"}, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		text     string
+		exempt   bool
+		want     string
+		warnings []string
+	}{
+		// escaping
+		{"ampersand", "fish & chips", false, "fish &amp; chips", []string{}},
+		{"angle brackets", "1 < 2 > 0", false, "1 &lt; 2 &gt; 0", []string{}},
+		{"html", "<b>hi</b>", false, "&lt;b&gt;hi&lt;/b&gt;", []string{}},
+		{"slack's own escapes", "&lt;!channel&gt;", false, "&amp;lt;!channel&amp;gt;", []string{}},
+
+		// broadcast mentions
+		{"channel markup", "hey <!channel>", false, "hey @channel", []string{warnBroadcast}},
+		{"everyone markup with label", "<!everyone|@all> look", false, "@all look", []string{warnBroadcast}},
+		{"subteam markup", "<!subteam^S1|@team>", false, "@team", []string{warnBroadcast}},
+		{"allowed broadcast", "<!here> and @here", false, "<!here> and <!here>", []string{}},
+		{"typed channel doesn't notify", "@channel", false, "@channel", []string{}},
+		{"exempt broadcast", "<!channel>", true, "<!channel>", []string{}},
+
+		// user mentions
+		{"user markup", "hi <@U1>", false, "hi @alice", []string{warnUserMention}},
+		{"unknown user markup", "hi <@U9|bob>", false, "hi @bob", []string{warnUserMention}},
+		{"typed user mention", "hi @alice", false, "hi @alice", []string{}},
+		{"exempt user mention", "hi @alice and <@U1>", true, "hi <@U1> and <@U1>", []string{}},
+		{"email isn't a mention", "bob@alice.com", true, "bob@alice.com", []string{}},
+		{"both", "<!channel> <@U1>", false, "@channel @alice", []string{warnBroadcast, warnUserMention}},
+
+		// links
+		{"link markup", "<https://example.com|example>", false, "<https://example.com|example>", []string{}},
+		{"markdown link", "[example](https://example.com)", false, "<https://example.com|example>", []string{}},
+		{"markdown link label", "[a <b>](https://example.com)", false, "<https://example.com|a &lt;b&gt;>", []string{}},
+		{"javascript markup", "<javascript:alert(1)|x>", false, "&lt;javascript:alert(1)|x&gt;", []string{}},
+		{"javascript markdown", "[x](javascript:alert(1))", false, "[x](javascript:alert(1))", []string{}},
+		{"mailto", "<mailto:a@example.com|mail>", false, "<mailto:a@example.com|mail>", []string{}},
+		{"channel link", "<#C1|general>", false, "<#C1|general>", []string{}},
+		{"unknown markup", "<foo>", false, "&lt;foo&gt;", []string{}},
+		{"exempt from link limit", "https://a.com https://b.com https://c.com", true, "https://a.com https://b.com https://c.com", []string{}},
+	}
+	for _, test := range tests {
+		got, warnings, err := policy.sanitize(test.text, test.exempt, testNames{})
+		if err != nil {
+			t.Errorf("%s: sanitize(%q) failed: %s", test.name, test.text, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: sanitize(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+		if !reflect.DeepEqual(warnings, test.warnings) {
+			t.Errorf("%s: sanitize(%q) warned %q, want %q", test.name, test.text, warnings, test.warnings)
+		}
+	}
+}
+
+func TestSanitizeLinkLimit(t *testing.T) {
+	policy, err := newOutboundPolicy(nil, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		text string
+		err  error
+	}{
+		{"https://a.com https://b.com", nil},
+		{"https://a.com https://b.com https://c.com", errTooManyLinks},
+		{"<https://a.com> [b](https://b.com) https://c.com", errTooManyLinks},
+		// links that don't go anywhere we'd link to aren't links
+		{"<https://a.com> [b](https://b.com) [c](javascript:x)", nil},
+		// nor is code
+		{"https://a.com https://b.com `https://c.com`", nil},
+	}
+	for _, test := range tests {
+		if _, _, err := policy.sanitize(test.text, false, testNames{}); err != test.err {
+			t.Errorf("sanitize(%q) = %v, want %v", test.text, err, test.err)
+		}
+	}
+}
+
+func TestNewOutboundPolicy(t *testing.T) {
+	if _, err := newOutboundPolicy([]string{"@here", " Channel ", ""}, false, 0); err != nil {
+		t.Errorf("newOutboundPolicy: %s", err)
+	}
+	if _, err := newOutboundPolicy([]string{"@bob"}, false, 0); err == nil {
+		t.Errorf("newOutboundPolicy accepted @bob as a broadcast mention")
+	}
+}
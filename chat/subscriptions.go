@@ -0,0 +1,49 @@
+package chat
+
+import "log"
+
+// subscribe adds a client to a channel's subscribers, so it's sent live
+// messages from there.
+func (h *Hub) subscribe(c *Client, channelID string) {
+	h.exec <- func() {
+		if _, ok := h.clients[c]; !ok {
+			return
+		}
+		subscribers, ok := h.subscribers[channelID]
+		if !ok {
+			subscribers = map[*Client]bool{}
+			h.subscribers[channelID] = subscribers
+		}
+		subscribers[c] = true
+		c.subscriptions[channelID] = true
+		log.Printf("client subscribed to %s (subscribers=%d)\n", channelID, len(subscribers))
+	}
+}
+
+func (h *Hub) unsubscribe(c *Client, channelID string) {
+	h.exec <- func() {
+		h.dropSubscription(c, channelID)
+	}
+}
+
+// dropSubscription removes a client from a channel's subscribers. it must run
+// on the hub goroutine.
+func (h *Hub) dropSubscription(c *Client, channelID string) {
+	delete(c.subscriptions, channelID)
+	subscribers := h.subscribers[channelID]
+	delete(subscribers, c)
+	if len(subscribers) == 0 {
+		delete(h.subscribers, channelID)
+	}
+}
+
+// removeClient forgets a client and everything it's subscribed to, letting its
+// writePump and anyone delivering to it know. it must run on the hub goroutine.
+func (h *Hub) removeClient(c *Client) {
+	for channelID := range c.subscriptions {
+		h.dropSubscription(c, channelID)
+	}
+	h.clientCount--
+	delete(h.clients, c)
+	close(c.gone)
+}
@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+func TestUnsubscribeStopsDelivery(t *testing.T) {
+	f := newFakeSlack(t, nil)
+	defer f.Close()
+	h := newChannelsHub(t, nil, nil)
+	defer close(h.exec)
+	soon := time.Now().Add(time.Hour)
+	bob := newAdminClient(h, "anon|bob", "bob", soon)
+	eve := newAdminClient(h, "anon|eve", "eve", soon)
+	inbox := func(c *Client, m map[string]string) {
+		h.handleInbox(&ClientMessage{Client: c, Raw: encode(m)})
+	}
+	said := func(channelIDs ...string) {
+		for _, channelID := range channelIDs {
+			h.handleSlackEvent(slack.RTMEvent{Data: &slack.MessageEvent{Msg: slack.Msg{Channel: channelID, User: "U1", Text: "hi", Timestamp: "1.1"}}})
+		}
+		flushBroadcasts(h)
+	}
+	channelsOf := func(c *Client) string {
+		var channels []string
+		for _, payload := range sent(c) {
+			for _, channelID := range []string{"C1", "C3"} {
+				if strings.Contains(payload, `"`+channelID+`"`) {
+					channels = append(channels, channelID)
+				}
+			}
+		}
+		return strings.Join(channels, ",")
+	}
+
+	inbox(bob, map[string]string{"type": "subscribe", "channel_id": "general"})
+	inbox(bob, map[string]string{"type": "subscribe", "channel_id": "C3"})
+	inbox(eve, map[string]string{"type": "subscribe", "channel_id": "general"})
+	said("C1", "C3")
+	if got := channelsOf(bob); got != "C1,C3" {
+		t.Errorf("bob got messages from %q, want C1,C3", got)
+	}
+	if got := channelsOf(eve); got != "C1" {
+		t.Errorf("eve got messages from %q, want C1", got)
+	}
+
+	// by name or id, and only for whoever unsubscribed
+	inbox(bob, map[string]string{"type": "unsubscribe", "channel_id": "general"})
+	said("C1", "C3")
+	if got := channelsOf(bob); got != "C3" {
+		t.Errorf("after unsubscribing from general, bob got messages from %q, want C3", got)
+	}
+	if got := channelsOf(eve); got != "C1" {
+		t.Errorf("eve got messages from %q, want C1", got)
+	}
+	inbox(bob, map[string]string{"type": "unsubscribe", "channel_id": "C3"})
+	said("C1", "C3")
+	if got := channelsOf(bob); got != "" {
+		t.Errorf("after unsubscribing from everything, bob got messages from %q", got)
+	}
+
+	// nobody's left listening to feedback, so it's forgotten
+	subscribed := make(chan int)
+	h.exec <- func() { subscribed <- len(h.subscribers) + len(bob.subscriptions) }
+	if n := <-subscribed; n != 1 {
+		t.Errorf("%d subscriptions left, want eve's", n)
+	}
+}
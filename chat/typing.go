@@ -0,0 +1,48 @@
+package chat
+
+import (
+	"log"
+
+	"github.com/nlopes/slack"
+)
+
+// forwardTyping tells a channel's subscribers an agent is typing. slack repeats
+// user_typing every few seconds while they type, so it's debounced, and clients
+// drop the indicator after it expires.
+func (h *Hub) forwardTyping(ev *slack.UserTypingEvent) {
+	if !h.channelVisible(ev.Channel) || ev.User == h.slackInfo.User.ID {
+		return
+	}
+	// visitors only see their own conversation in these, and slack doesn't say
+	// which thread someone is typing in
+	if mode := h.channelModeFor(ev.Channel); mode == ChannelPostOnly || mode == ChannelHelpDesk {
+		return
+	}
+	if !h.agentTyping.allow(ev.Channel + "/" + ev.User) {
+		return
+	}
+	user := &chatUser{ID: ev.User}
+	if u := h.slackUser(ev.User); u != nil {
+		user.Username, user.Avatar = u.Name, u.Profile.ImageOriginal
+	}
+	h.broadcast <- &channelBroadcast{channelID: ev.Channel, payload: EncodeTypingEvent(ev.Channel, user, h.typingExpiry)}
+}
+
+// sendTyping lets slack know a visitor is typing. slack can only show it as our
+// own user typing.
+func (h *Hub) sendTyping(id *identity, idOrName string) {
+	if id == nil || h.revoked.isRevoked(id) {
+		return
+	}
+	if !h.typingLimit.allow(id.Subject) {
+		return
+	}
+	channelID := h.resolveSlackChannel(idOrName)
+	if channelID == "" || !h.canAccess(id, channelID) || h.channelMode(id, channelID) == ChannelReadOnly {
+		return
+	}
+	if h.logMessages {
+		log.Printf("typing as client %s in %s\n", id.User.Username, channelID)
+	}
+	h.rtm.SendMessage(h.rtm.NewTypingMessage(channelID))
+}
@@ -0,0 +1,41 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// visitors only see their own conversation in post-only and help-desk channels,
+// so they aren't told who's typing there
+func TestForwardTyping(t *testing.T) {
+	f := newFakeSlack(t, nil)
+	defer f.Close()
+	h := newChannelsHub(t, []string{"internal"}, map[string]string{"feedback": ChannelPostOnly, "support": ChannelHelpDesk})
+	defer close(h.exec)
+	h.agentTyping = newRateLimiter(time.Hour, 1)
+	bob := newAdminClient(h, "anon|bob", "bob", time.Now().Add(time.Hour))
+	for _, channel := range []string{"general", "feedback", "support"} {
+		h.handleInbox(&ClientMessage{Client: bob, Raw: encode(map[string]string{"type": "subscribe", "channel_id": channel})})
+	}
+
+	typing := func(channelID, user string) {
+		h.handleSlackEvent(slack.RTMEvent{Data: &slack.UserTypingEvent{Type: "user_typing", Channel: channelID, User: user}})
+	}
+	for _, channelID := range []string{"C1", "C2", "C3", "C4"} {
+		typing(channelID, "U1")
+	}
+	// nor about ourselves, and an agent who keeps typing is only forwarded once
+	typing("C1", "UME")
+	typing("C1", "U1")
+	if len(h.broadcast) != 1 {
+		t.Errorf("%d broadcasts, want just general's", len(h.broadcast))
+	}
+	flushBroadcasts(h)
+	payloads := sent(bob)
+	if len(payloads) != 1 || !strings.Contains(payloads[0], `"C1"`) {
+		t.Errorf("bob was sent %q, want U1 typing in general", payloads)
+	}
+}
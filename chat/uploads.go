@@ -0,0 +1,453 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/nlopes/slack"
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+var slackTs = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// the form fields besides the file are all short
+const maxUploadFieldSize = 4000
+
+// visitorUploads remembers which visitor uploaded which slack file. slack shows
+// our own user as having shared them, so this is how we attribute them back.
+// it's optionally mirrored to a json file.
+type visitorUploads struct {
+	mu   sync.Mutex
+	path string
+
+	// file id -> who uploaded it
+	byFile map[string]*uploader
+
+	// uploads still on their way to slack, since the file_share message can
+	// arrive before files.upload tells us the file's id
+	pending []*pendingUpload
+}
+type uploader struct {
+	Subject  string `json:"subject"`
+	Username string `json:"username"`
+}
+type pendingUpload struct {
+	channelID string
+	name      string
+	size      int
+	by        *uploader
+}
+
+func newVisitorUploads(path string) (*visitorUploads, error) {
+	u := &visitorUploads{path: path, byFile: map[string]*uploader{}}
+	if path == "" {
+		return u, nil
+	}
+	if err := loadJSONFile(path, &u.byFile); err != nil {
+		return nil, err
+	}
+	if u.byFile == nil {
+		u.byFile = map[string]*uploader{}
+	}
+	log.Printf("loaded %d visitor uploads from %s\n", len(u.byFile), path)
+	return u, nil
+}
+
+// expect notes an upload we're about to send, returning a func to call once
+// slack has it (or it failed).
+func (u *visitorUploads) expect(p *pendingUpload) func() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending = append(u.pending, p)
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.dropPending(p)
+	}
+}
+
+func (u *visitorUploads) dropPending(p *pendingUpload) {
+	for i := range u.pending {
+		if u.pending[i] == p {
+			u.pending = append(u.pending[:i], u.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// add records who uploaded a file.
+func (u *visitorUploads) add(fileID string, by *uploader) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addLocked(fileID, by)
+}
+
+func (u *visitorUploads) addLocked(fileID string, by *uploader) {
+	u.byFile[fileID] = by
+	if u.path == "" {
+		return
+	}
+	if err := saveJSONFile(u.path, u.byFile); err != nil {
+		log.Printf("error: couldn't save visitor uploads to %s - %s\n", u.path, err)
+	}
+}
+
+// uploader returns who uploaded a file, or nil if it wasn't a visitor.
+func (u *visitorUploads) uploader(fileID string) *uploader {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.byFile[fileID]
+}
+
+// uploaderOf is uploader for a file we just saw shared into a channel, which
+// may be an upload we haven't heard back from slack about yet.
+func (u *visitorUploads) uploaderOf(channelID string, f *slack.File) *uploader {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if by := u.byFile[f.ID]; by != nil {
+		return by
+	}
+	for _, p := range u.pending {
+		if p.channelID == channelID && p.name == f.Name && p.size == f.Size {
+			u.dropPending(p)
+			u.addLocked(f.ID, p.by)
+			return p.by
+		}
+	}
+	return nil
+}
+
+// uploadComment is the text slack shows with a visitor's file, so agents know
+// who sent it. comment is already sanitized.
+func uploadComment(username, comment string) string {
+	if comment == "" {
+		return fmt.Sprintf("*%s* shared a file", escapeMrkdwn(username))
+	}
+	return fmt.Sprintf("*%s*: %s", escapeMrkdwn(username), comment)
+}
+
+// attributeUpload presents a file a visitor uploaded as theirs, the same way
+// their messages come through as bot messages under their name.
+func (h *Hub) attributeUpload(channelID string, m *slack.Msg) {
+	if m == nil || m.SubType != "file_share" || m.File == nil || m.User != h.slackInfo.User.ID {
+		return
+	}
+	by := h.uploads.uploaderOf(channelID, m.File)
+	if by == nil {
+		return
+	}
+	m.SubType = "bot_message"
+	m.Username = by.Username
+	if m.Text == uploadComment(by.Username, "") {
+		m.Text = ""
+	} else {
+		m.Text = strings.TrimPrefix(m.Text, fmt.Sprintf("*%s*: ", escapeMrkdwn(by.Username)))
+	}
+}
+
+// uploadFilename keeps the base name of what the browser sent, minus anything
+// that could confuse slack or our headers.
+func uploadFilename(raw string) string {
+	name := path.Base(strings.Replace(raw, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "upload"
+	}
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[len(runes)-100:])
+	}
+	return name
+}
+
+// progressReader reports how much of an upload has been read, every step bytes.
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	reported int64
+	step     int64
+	report   func(read int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.read-p.reported >= p.step {
+		p.reported = p.read
+		p.report(p.read)
+	}
+	return n, err
+}
+
+type uploadError struct {
+	status int
+	reason string
+}
+
+func (e *uploadError) Error() string {
+	return e.reason
+}
+
+// uploadTarget checks an identity may share a file into a channel, or a thread
+// in it, returning the channel's id and the thread to use. visitors' uploads in
+// help-desk channels always go in their own thread, so the thread is left to
+// the caller there.
+func (h *Hub) uploadTarget(id *identity, channel, threadTs string) (string, string, error) {
+	channelID := h.resolveSlackChannel(channel)
+	if channelID == "" {
+		return "", "", &uploadError{http.StatusNotFound, "no such channel"}
+	}
+	if !h.canAccess(id, channelID) {
+		return "", "", &uploadError{http.StatusForbidden, "you weren't invited to that channel"}
+	}
+	if h.channelMode(id, channelID) == ChannelReadOnly {
+		return "", "", &uploadError{http.StatusForbidden, "this channel is read-only"}
+	}
+	threadTs, err := h.replyThread(id, channelID, threadTs)
+	if err != nil {
+		return "", "", &uploadError{http.StatusBadRequest, err.Error()}
+	}
+	return channelID, threadTs, nil
+}
+
+type slackUpload struct {
+	channelID string
+	threadTs  string
+	name      string
+	comment   string
+	data      []byte
+}
+
+// uploadToSlack shares a file into a channel, or a thread in it, as our slack
+// user. the vendored slack client's UploadFile predates thread_ts, so we call
+// files.upload ourselves.
+func uploadToSlack(token string, u *slackUpload) (*slack.File, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := [][2]string{
+		{"channels", u.channelID},
+		{"thread_ts", u.threadTs},
+		{"filename", u.name},
+		{"title", u.name},
+		{"initial_comment", u.comment},
+	}
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return nil, err
+		}
+	}
+	part, err := form.CreateFormFile("file", u.name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(u.data); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", slack.SLACK_API+"files.upload", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := fileClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Ok    bool        `json:"ok"`
+		Error string      `json:"error"`
+		File  *slack.File `json:"file"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("files.upload responded %s", resp.Status)
+	}
+	if !result.Ok || result.File == nil {
+		return nil, fmt.Errorf("files.upload failed: %s", result.Error)
+	}
+	return result.File, nil
+}
+
+// ServeUpload shares a visitor's file into slack for them (a multipart
+// POST /uploads, with channel_id and optional thread_ts and comment fields
+// ahead of the file). visitors authenticate with their identity token as a
+// bearer token. their websockets get upload-progress events as the file is
+// received and forwarded, tagged with the X-Upload-ID they pass, and the
+// file_share message comes through like any other.
+func ServeUpload(cfg *Config, hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if hub.slackInfo == nil {
+		http.Error(w, "not connected to slack yet", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := hub.identityFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	uploadID := r.Header.Get("X-Upload-ID")
+	if !uploadIDPattern.MatchString(uploadID) {
+		if uploadID, err = randomHex(8); err != nil {
+			http.Error(w, "couldn't start upload", http.StatusInternalServerError)
+			return
+		}
+	}
+	total := r.ContentLength
+	progress := func(stage string, received int64, f *chatFile, reason string) {
+		hub.sendWhere(func(c *Client) bool {
+			return c.identity != nil && c.identity.Subject == id.Subject
+		}, EncodeUploadProgressMessage(uploadID, stage, received, total, f, reason))
+	}
+	fail := func(status int, reason string) {
+		log.Printf("warn: rejected upload %s from %s - %s\n", uploadID, id.User.Username, reason)
+		progress("failed", 0, nil, reason)
+		http.Error(w, reason, status)
+	}
+
+	if id.Role == RoleVisitor && !hub.sendLimit.allow(id.Subject) {
+		fail(http.StatusTooManyRequests, "you're sending messages too quickly, slow down")
+		return
+	}
+	// a little room for the other fields and multipart framing
+	r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.Server.UploadMaxSize)+1<<16)
+	parts, err := r.MultipartReader()
+	if err != nil {
+		fail(http.StatusBadRequest, "expected a multipart upload")
+		return
+	}
+	fields := map[string]string{}
+	var channelID, threadTs, name string
+	var data []byte
+	for data == nil {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fail(http.StatusBadRequest, "couldn't read the upload")
+			return
+		}
+		if part.FormName() != "file" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxUploadFieldSize))
+			if err != nil {
+				fail(http.StatusBadRequest, "couldn't read the upload")
+				return
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		// check where it's going before reading the file itself
+		if channelID, threadTs, err = hub.uploadTarget(id, fields["channel_id"], fields["thread_ts"]); err != nil {
+			ue := err.(*uploadError)
+			fail(ue.status, ue.reason)
+			return
+		}
+		name = uploadFilename(part.FileName())
+		step := total / 10
+		if step < 1<<16 {
+			step = 1 << 16
+		}
+		file := &progressReader{r: part, step: step, report: func(read int64) {
+			progress("receiving", read, nil, "")
+		}}
+		if data, err = ioutil.ReadAll(io.LimitReader(file, int64(cfg.Server.UploadMaxSize)+1)); err != nil {
+			fail(http.StatusRequestEntityTooLarge, "file is too large")
+			return
+		}
+	}
+	if data == nil {
+		fail(http.StatusBadRequest, "no file in the upload")
+		return
+	}
+	if len(data) == 0 {
+		fail(http.StatusBadRequest, "file is empty")
+		return
+	}
+	if len(data) > cfg.Server.UploadMaxSize {
+		fail(http.StatusRequestEntityTooLarge, "file is too large")
+		return
+	}
+	// go by what it is, not what the browser says it is
+	mimetype := http.DetectContentType(data)
+	if !fileTypeAllowed(cfg.Server.UploadTypes, mimetype) {
+		fail(http.StatusUnsupportedMediaType, "file type not allowed")
+		return
+	}
+
+	comment, warnings, err := hub.outbound.sanitize(strings.TrimSpace(fields["comment"]), id.Role == RoleModerator, hub)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(warnings) != 0 {
+		hub.sendWhere(func(c *Client) bool {
+			return c.identity != nil && c.identity.Subject == id.Subject
+		}, EncodeMessageWarningMessage(channelID, strings.Join(warnings, ", ")))
+	}
+	if hub.channelMode(id, channelID) == ChannelHelpDesk {
+		// their comment starts their thread if they don't have one yet
+		if threadTs = hub.helpDesk.thread(channelID, id.Subject); threadTs == "" {
+			text := comment
+			if text == "" {
+				text = "shared a file"
+			}
+			if threadTs, err = hub.postHelpDeskMessage(id, channelID, text); err != nil {
+				log.Printf("error: failed to start help-desk thread for upload - %s\n", err)
+				fail(http.StatusBadGateway, "couldn't share the file in slack")
+				return
+			}
+			comment = ""
+		}
+	}
+
+	log.Printf("uploading %s (%s, %d bytes) as client %s to %s\n", name, mimetype, len(data), id.User.Username, channelID)
+	progress("forwarding", int64(len(data)), nil, "")
+	by := &uploader{Subject: id.Subject, Username: id.User.Username}
+	done := hub.uploads.expect(&pendingUpload{channelID: channelID, name: name, size: len(data), by: by})
+	f, err := uploadToSlack(cfg.Slack.Token, &slackUpload{
+		channelID: channelID,
+		threadTs:  threadTs,
+		name:      name,
+		comment:   uploadComment(id.User.Username, comment),
+		data:      data,
+	})
+	done()
+	if err != nil {
+		log.Printf("error: failed to upload - %s\n", err)
+		fail(http.StatusBadGateway, "couldn't share the file in slack")
+		return
+	}
+	hub.uploads.add(f.ID, by)
+
+	payload := EncodeUploadProgressMessage(uploadID, "done", int64(len(data)), total, newChatFile(f), "")
+	hub.sendWhere(func(c *Client) bool {
+		return c.identity != nil && c.identity.Subject == id.Subject
+	}, payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
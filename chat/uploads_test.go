@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeUploadRefusesFiles(t *testing.T) {
+	f := newFakeSlack(t, func(method string, form url.Values) map[string]interface{} {
+		if method == "files.upload" {
+			return map[string]interface{}{"ok": true, "file": map[string]interface{}{"id": "F1", "name": "a.png"}}
+		}
+		return nil
+	})
+	defer f.Close()
+	h := newChannelsHub(t, nil, nil)
+	defer close(h.exec)
+	cfg := &Config{}
+	cfg.Server.UploadMaxSize, cfg.Server.UploadTypes = 100, []string{"image/png"}
+	bob := newAdminClient(h, "anon|bob", "bob", time.Now().Add(time.Hour))
+	_, token, err := signUserJWT(h.keys, h.identityOf(bob), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 20)...)
+	tests := []struct {
+		name     string
+		data     []byte
+		status   int
+		uploaded bool
+	}{
+		{"a.png", png, http.StatusOK, true},
+		{"large.png", append(png, make([]byte, 100)...), http.StatusRequestEntityTooLarge, false},
+		{"page.png", []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType, false},
+		{"empty.png", []byte{}, http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("channel_id", "general")
+		part, _ := form.CreateFormFile("file", test.name)
+		part.Write(test.data)
+		form.Close()
+		r := httptest.NewRequest("POST", "/uploads", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("X-Upload-ID", "up1")
+
+		before := len(f.called("files.upload"))
+		w := httptest.NewRecorder()
+		ServeUpload(cfg, h, w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, strings.TrimSpace(w.Body.String()), test.status)
+		}
+		if uploaded := len(f.called("files.upload")) > before; uploaded != test.uploaded {
+			t.Errorf("%s: uploaded = %v, want %v", test.name, uploaded, test.uploaded)
+		}
+		// the uploader's socket hears how it went, once the hub gets to it
+		h.clientsWhere(func(*Client) bool { return false })
+		payloads := sent(bob)
+		want := `"stage":"done"`
+		if !test.uploaded {
+			want = `"stage":"failed"`
+		}
+		if len(payloads) == 0 || !strings.Contains(payloads[len(payloads)-1], want) {
+			t.Errorf("%s: bob was sent %q, want %s last", test.name, payloads, want)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/blaskovicz/cut-me-some-slack/chat"
 )
@@ -15,6 +18,69 @@ func startStreamFunc(cfg *chat.Config, hub *chat.Hub) func(w http.ResponseWriter
 	}
 }
 
+func serveJWKSFunc(hub *chat.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chat.ServeJWKS(hub, w, r)
+	}
+}
+
+func serveOIDCLoginFunc(hub *chat.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("serving /login")
+		chat.ServeOIDCLogin(hub, w, r)
+	}
+}
+
+func serveOIDCCallbackFunc(hub *chat.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("serving /callback")
+		chat.ServeOIDCCallback(hub, w, r)
+	}
+}
+
+func serveUploadFunc(cfg *chat.Config, hub *chat.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("serving %s\n", r.URL.Path)
+		chat.ServeUpload(cfg, hub, w, r)
+	}
+}
+
+func serveFileFunc(cfg *chat.Config, hub *chat.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("serving %s\n", r.URL.Path)
+		chat.ServeFile(cfg, hub, w, r)
+	}
+}
+
+func serveAdminFunc(cfg *chat.Config, hub *chat.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("serving %s %s\n", r.Method, r.URL.Path)
+		chat.ServeAdmin(cfg, hub, w, r)
+	}
+}
+
+// invite prints a signed invite link, eg: cut-me-some-slack invite -channels support,general -expires 24h -max-uses 5
+func invite(cfg *chat.Config, args []string) {
+	flags := flag.NewFlagSet("invite", flag.ExitOnError)
+	channels := flags.String("channels", "", "comma-separated channel names or ids to invite into")
+	expires := flags.Duration("expires", cfg.Server.InviteTTL, "how long the link is valid for")
+	maxUses := flags.Int("max-uses", 0, "how many visitors can use the link, 0 for unlimited")
+	flags.Parse(args)
+
+	var channelList []string
+	for _, c := range strings.Split(*channels, ",") {
+		if c = strings.TrimPrefix(strings.TrimSpace(c), "#"); c != "" {
+			channelList = append(channelList, c)
+		}
+	}
+	inviteURL, expiresAt, err := chat.NewInviteURL(cfg, channelList, *expires, *maxUses)
+	if err != nil {
+		log.Fatalf("Failed to create invite: %s", err)
+	}
+	log.Printf("invite for %v expires %s", channelList, expiresAt)
+	fmt.Println(inviteURL)
+}
+
 func main() {
 	// load env
 	cfg, err := chat.LoadConfig()
@@ -22,15 +88,31 @@ func main() {
 		log.Fatal("Failed to load config: ", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "invite" {
+		invite(cfg, os.Args[2:])
+		return
+	}
+
 	// start hub
 	hub, err := chat.NewHub(cfg)
 	if err != nil {
-		log.Fatal("Failed to launch hub: %s", err)
+		log.Fatalf("Failed to launch hub: %s", err)
 	}
 	go hub.Run()
 
 	// stream is mapped to websocket conn
 	http.HandleFunc("/stream", startStreamFunc(cfg, hub))
+	// optional oidc login, 404s unless configured
+	http.HandleFunc("/login", serveOIDCLoginFunc(hub))
+	http.HandleFunc("/callback", serveOIDCCallbackFunc(hub))
+	// slack files, for visitors that can see them
+	http.HandleFunc("/files/", serveFileFunc(cfg, hub))
+	// visitors sharing files into slack
+	http.HandleFunc("/uploads", serveUploadFunc(cfg, hub))
+	// admin api, 404s unless ADMIN_TOKEN is set
+	http.HandleFunc("/admin/", serveAdminFunc(cfg, hub))
+	// public keys for verifying identity tokens elsewhere
+	http.HandleFunc("/.well-known/jwks.json", serveJWKSFunc(hub))
 	// anything starting with /static goes to ui/build dir (eg: /static/foo -> ui/build/static/foo)
 	http.Handle("/static/", http.FileServer(http.Dir("ui/build")))
 	// lastly, re-map anything else directly to the index.html page for single page routing
@@ -4,18 +4,224 @@ import emojione from 'emojione';
 import PropTypes from 'prop-types';
 import moment from 'moment';
 import VisibilitySensor from 'react-visibility-sensor';
+import FontAwesome from 'react-fontawesome';
 // import { Link } from 'react-router-dom';
+import { HTTP_URI } from '../lib/env';
 import './Message.css';
 
+const formatSize = bytes => {
+  if (bytes >= 1024 * 1024) return `${(bytes / (1024 * 1024)).toFixed(1)} MB`;
+  if (bytes >= 1024) return `${Math.round(bytes / 1024)} KB`;
+  return `${bytes} B`;
+};
+
+// legacy slack attachments, as sanitized by the server. everything is rendered as text.
+const Attachment = ({ a }) => (
+  <div style={{ borderLeft: `4px solid ${a.color || '#ddd'}`, paddingLeft: '8px', margin: '5px 0' }}>
+    {a.pretext && <div>{a.pretext}</div>}
+    {a.author_name &&
+      <div style={{ fontSize: '10pt' }}>
+        {a.author_icon && <img src={a.author_icon} alt="" style={{ width: '16px', height: '16px', marginRight: '5px' }} />}
+        {a.author_link ? <a href={a.author_link} target="_blank" rel="noopener noreferrer">{a.author_name}</a> : a.author_name}
+      </div>
+    }
+    {a.title &&
+      <div style={{ fontWeight: 'bold' }}>
+        {a.title_link ? <a href={a.title_link} target="_blank" rel="noopener noreferrer">{a.title}</a> : a.title}
+      </div>
+    }
+    {a.text && <div style={{ whiteSpace: 'pre-wrap' }}>{a.text}</div>}
+    {!a.text && !a.title && !a.fields && a.fallback && <div style={{ whiteSpace: 'pre-wrap' }}>{a.fallback}</div>}
+    {a.fields &&
+      <div>
+        {a.fields.map(f =>
+          <div key={`${f.title}-${f.value}`} style={{ display: 'inline-block', width: f.short ? '50%' : '100%', verticalAlign: 'top' }}>
+            <div style={{ fontWeight: 'bold', fontSize: '10pt' }}>{f.title}</div>
+            <div style={{ whiteSpace: 'pre-wrap' }}>{f.value}</div>
+          </div>
+        )}
+      </div>
+    }
+    {(a.image_url || a.thumb_url) &&
+      <img src={a.image_url || a.thumb_url} alt={a.title || a.fallback || ''} style={{ maxWidth: '100%', maxHeight: '300px' }} />
+    }
+    {a.footer && <div style={{ fontSize: '9pt', color: '#929191' }}>{a.footer}</div>}
+  </div>
+);
+Attachment.propTypes = { a: PropTypes.object.isRequired };
+
+// slack files need our identity token, so they're fetched rather than linked
+const fetchFile = file => fetch(`${HTTP_URI}${file.url}`, {
+  headers: { Authorization: `Bearer ${localStorage.getItem('jwt')}` },
+}).then(res => {
+  if (!res.ok) throw new Error(`${res.status} ${res.statusText}`);
+  return res.blob();
+}).then(blob => URL.createObjectURL(blob));
+
+class SharedFile extends Component {
+  static propTypes = { file: PropTypes.object.isRequired };
+  state = { src: null, error: null };
+  componentDidMount() {
+    if (this.isImage()) this.load();
+  }
+  componentWillUnmount() {
+    this.unmounted = true;
+    if (this.state.src) URL.revokeObjectURL(this.state.src);
+  }
+  isImage = () => /^image\//.test(this.props.file.mimetype || '');
+  load() {
+    return fetchFile(this.props.file).then(src => {
+      if (this.unmounted) {
+        URL.revokeObjectURL(src);
+        return null;
+      }
+      this.setState({ src });
+      return src;
+    }).catch(error => this.setState({ error: error.message }));
+  }
+  download = e => {
+    e.preventDefault();
+    const { file } = this.props;
+    (this.state.src ? Promise.resolve(this.state.src) : this.load()).then(src => {
+      if (!src) return;
+      const a = document.createElement('a');
+      a.href = src;
+      a.download = file.name;
+      a.click();
+    });
+  };
+  render() {
+    const { file } = this.props;
+    const { src, error } = this.state;
+    return (
+      <div className="alert alert-secondary" style={{ padding: '5px', margin: '5px 0' }}>
+        {this.isImage() && src &&
+          <img src={src} alt={file.title || file.name} style={{ maxWidth: '100%', maxHeight: '300px', display: 'block' }} />
+        }
+        {/* eslint-disable-next-line jsx-a11y/href-no-hash */}
+        <a href="#" onClick={this.download}>
+          <FontAwesome name="file" /> {file.title || file.name}
+        </a> <small>({formatSize(file.size)})</small>
+        {error && <small style={{ color: '#a30200', marginLeft: '5px' }}>unavailable ({error})</small>}
+      </div>
+    );
+  }
+}
+
+// markdown's own characters, shown as typed
+const escapeLabel = text => text.replace(/([\\`*_{}[\]()#+\-.!<>&~|])/g, '\\$1');
+
+// only links we'd follow ourselves; javascript:, data: and the like go nowhere
+export const safeUri = uri => (/^(https?:\/\/|mailto:|\/messages\/)/i.test(uri || '') ? uri : null);
+
+const markdownUri = uri => `<${uri.replace(/[<>\s]/g, encodeURIComponent)}>`;
+
+// the server resolves slack's markup into segments; we just turn them into
+// markdown. it's rendered with html escaped, so only segments become links or images.
+export const segmentMarkdown = (s, channels) => {
+  switch (s.type) {
+    case 'user':
+    case 'special':
+      return `**${escapeLabel(s.text)}**`;
+    case 'channel':
+      return channels && channels[s.id] && /^[A-Z0-9]+$/.test(s.id) ? `[${escapeLabel(s.text)}](/messages/${s.id})` : escapeLabel(s.text);
+    case 'link':
+      return safeUri(s.url) ? `[${escapeLabel(s.text)}](${markdownUri(s.url)})` : escapeLabel(s.text);
+    case 'emoji':
+      if (s.url && safeUri(s.url)) return `![${escapeLabel(s.name)}](${markdownUri(s.url)})`;
+      // fix random emojis that don't proc because #emojioneBugs
+      return emojione.shortnameToUnicode(s.name === '+1' ? ':thumbsup:' : s.text);
+    default:
+      return s.text;
+  }
+};
+
+// block kit text renders like message text, except plain_text isn't formatted
+const blockMarkdown = (t, channels) => (t.type === 'plain_text' ?
+  escapeLabel(t.segments.map(s => s.text).join('')) :
+  t.segments.map(s => segmentMarkdown(s, channels)).join(''));
+
+const BlockText = ({ t, channels }) => (
+  <div style={{ whiteSpace: 'pre-wrap' }} className="room-message">
+    <ReactMarkdown source={blockMarkdown(t, channels)} escapeHtml transformLinkUri={safeUri} transformImageUri={safeUri} />
+  </div>
+);
+BlockText.propTypes = { t: PropTypes.object.isRequired, channels: PropTypes.object };
+
+// block kit blocks, as flattened by the server
+const Block = ({ b, channels }) => {
+  const image = safeUri(b.image_url);
+  switch (b.type) {
+    case 'header':
+      return <div style={{ fontWeight: 'bold', fontSize: '14pt' }}><BlockText t={b.text} channels={channels} /></div>;
+    case 'divider':
+      return <hr style={{ margin: '5px 0' }} />;
+    case 'context':
+      return (
+        <div style={{ fontSize: '9pt', color: '#929191' }}>
+          {/* eslint-disable-next-line react/no-array-index-key */}
+          {b.elements.map((t, i) => <BlockText key={i} t={t} channels={channels} />)}
+        </div>
+      );
+    case 'image':
+      return (
+        <div style={{ margin: '5px 0' }}>
+          {b.title && <div style={{ fontSize: '10pt' }}>{b.title}</div>}
+          {image && <img src={image} alt={b.alt_text || ''} style={{ maxWidth: '100%', maxHeight: '300px' }} />}
+        </div>
+      );
+    default:
+      return (
+        <div style={{ margin: '5px 0', overflow: 'auto' }}>
+          {image && <img src={image} alt={b.alt_text || ''} style={{ float: 'right', width: '88px', height: '88px', marginLeft: '5px' }} />}
+          {b.text && <BlockText t={b.text} channels={channels} />}
+          {b.fields && b.fields.map((f, i) =>
+            // eslint-disable-next-line react/no-array-index-key
+            <div key={i} style={{ display: 'inline-block', width: '50%', verticalAlign: 'top' }}>
+              <BlockText t={f} channels={channels} />
+            </div>
+          )}
+        </div>
+      );
+  }
+};
+Block.propTypes = { b: PropTypes.object.isRequired, channels: PropTypes.object };
+
 export default class Message extends Component {
   static propTypes = {
     notifyVisible: PropTypes.func.isRequired,
     users: PropTypes.object,
     channels: PropTypes.object,
     emoji: PropTypes.object,
+    replies: PropTypes.array,
+    threadOpen: PropTypes.bool,
+    onToggleThread: PropTypes.func,
+    onReact: PropTypes.func,
     msg: PropTypes.shape({
       text: PropTypes.string,
       ts: PropTypes.string.isRequired,
+      thread_ts: PropTypes.string,
+      reply_count: PropTypes.number,
+      edited: PropTypes.bool,
+      segments: PropTypes.arrayOf(PropTypes.shape({
+        type: PropTypes.string.isRequired,
+        text: PropTypes.string.isRequired,
+      })),
+      attachments: PropTypes.array,
+      blocks: PropTypes.arrayOf(PropTypes.shape({
+        type: PropTypes.string.isRequired,
+      })),
+      file: PropTypes.shape({
+        id: PropTypes.string.isRequired,
+        name: PropTypes.string,
+        title: PropTypes.string,
+        size: PropTypes.number,
+        url: PropTypes.string,
+      }),
+      reactions: PropTypes.arrayOf(PropTypes.shape({
+        name: PropTypes.string.isRequired,
+        count: PropTypes.number.isRequired,
+      })),
       user: PropTypes.shape({
         avatar_url: PropTypes.string,
         username: PropTypes.string.isRequired,
@@ -24,98 +230,17 @@ export default class Message extends Component {
   };
 
   parsedMessage() {
-    const { msg, users, channels, emoji } = this.props;
+    const { msg, channels } = this.props;
     if (!msg.text || msg.parsed) return msg;
-    // correct anything out of the norm in the text.
-    let startIndex = -1;
-    let endIndex = -1;
-    let labelIndex = -1;
-    let emojiIndex = -1;
-    // TODO my token replacement logic is flawed since it changes
-    // the string in place but doesnt update its index
-    for (let i = 0; i < msg.text.length; i += 1) {
-      const charAt = msg.text[i];
-      if (charAt === '<') {
-        startIndex = i;
-        endIndex = -1;
-        labelIndex = -1;
-        emojiIndex = -1;
-      } else if (charAt === '|') {
-        labelIndex = i;
-        emojiIndex = -1;
-      } else if (charAt === '>' && startIndex > -1) {
-        endIndex = i;
-        emojiIndex = -1;
-        // eg: <#c1234|misc> -> #c1234
-        const token = msg.text.substring(
-          startIndex + 1,
-          labelIndex === -1 ? endIndex : labelIndex,
-        );
-        let newToken;
-        if (token[0] === '#') {
-          // channel
-          const matchedChannel = channels && channels[token.substring(1)];
-          if (matchedChannel) {
-            // TODO ugh. newToken = <Link to={`/messages/${matchedChannel.id}`}>#${matchedChannel.name}</Link>;
-            newToken = `[#${matchedChannel.name}](/messages/${matchedChannel.id})`;
-            // console.log(newToken)
-          }
-        } else if (token[0] === '@') {
-          // username
-          const matchedUser = users && users[token.substring(1)];
-          if (matchedUser) {
-            newToken = `@${matchedUser.username}`;
-          }
-        } else {
-          // link
-          newToken = labelIndex !== -1 ?
-            `[${msg.text.substring(labelIndex + 1, endIndex)}](${token})` : `[${token}](${token})`;
-        }
-        if (newToken && token !== newToken) {
-          // console.log(`[message.parse] replacing ${msg.text.substring(startIndex, endIndex + 1)} (s=${startIndex}, e=${endIndex}, l=${labelIndex}) with ${newToken}`);
-          msg.text = msg.text.slice(0, startIndex) + newToken + msg.text.slice(endIndex + 1);
-        }
-        startIndex = -1;
-        endIndex = -1;
-        labelIndex = -1;
-      } else if (charAt === ':') {
-        // fix random emojis that don't proc because #emojioneBugs
-        if (emojiIndex === -1) {
-          emojiIndex = i;
-        } else {
-          const token = msg.text.substring(emojiIndex + 1, i);
-          let newToken;
-          // console.log(`[message.parse] emoji ${emoji}`);
-          if (token === '+1') {
-            newToken = ':thumbsup:';
-          } else {
-            let targetEmoji = emoji[token];
-            // resolve aliases eg: foo -> alias:bar -> bar -> alias:baz -> baz -> baz/url.png
-            while (targetEmoji !== undefined && targetEmoji.indexOf('alias:') === 0) {
-              targetEmoji = emoji[targetEmoji.split('alias:')[1]];
-            }
-            if (targetEmoji) {
-              newToken = `<img alt="${token}" title="${token}" src="${targetEmoji}" style="width: 32px; height: 32px">`;
-            }
-          }
-
-          if (newToken && token !== newToken) {
-            msg.text = msg.text.slice(0, emojiIndex) + newToken + msg.text.slice(i + 1);
-          }
-          emojiIndex = -1;
-        }
-      } else if (!/[a-zA-Z0-9_\-+]/.test(charAt)) {
-        emojiIndex = -1;
-      }
-    }
-    // TODO mix in custom emojis (https://api.slack.com/methods/emoji.list)
-    msg.text = emojione.toImage(msg.text);
+    msg.text = (msg.segments || [{ type: 'text', text: msg.text }]).map(s => segmentMarkdown(s, channels)).join('');
     msg.parsed = true;
     return msg;
   }
   render() {
-    const { notifyVisible } = this.props;
+    const { notifyVisible, replies, threadOpen, onToggleThread, onReact, users, channels, emoji } = this.props;
     const msg = this.parsedMessage();
+    // live replies may be ahead of the count we got with the parent
+    const replyCount = Math.max(msg.reply_count || 0, (replies || []).length);
     const shortTime = moment(msg.ts * 1000).format('MMM Do, h:mm a');
     const longTime = moment(msg.ts * 1000).format();
     return (
@@ -141,11 +266,58 @@ export default class Message extends Component {
               <h6 className="card-title">
                 {msg.user && <span style={{ marginRight: '5px', fontWeight: 'bold' }}>{msg.user.username}</span>}
                 <span style={{ fontSize: '10pt', color: '#929191' }} title={longTime}>{shortTime}</span>
+                {msg.edited && <span style={{ fontSize: '10pt', color: '#929191', marginLeft: '5px' }}>(edited)</span>}
               </h6>
-              {/* TODO links, sigils and whatnot */}
+              {/* text is only a fallback for blocks */}
               <div style={{ whiteSpace: 'pre-wrap', overflow: 'auto' }} className="room-message">
-                {msg.text && <ReactMarkdown source={msg.text} />}
+                {msg.text && !msg.blocks && <ReactMarkdown source={msg.text} escapeHtml transformLinkUri={safeUri} transformImageUri={safeUri} />}
               </div>
+              {msg.blocks && msg.blocks.map((b, i) =>
+                // eslint-disable-next-line react/no-array-index-key
+                <Block key={i} b={b} channels={channels} />
+              )}
+              {msg.attachments && msg.attachments.map((a, i) =>
+                // eslint-disable-next-line react/no-array-index-key
+                <Attachment key={i} a={a} />
+              )}
+              {msg.file && <SharedFile file={msg.file} />}
+              {msg.reactions && msg.reactions.length !== 0 &&
+                <div>
+                  {msg.reactions.map(r =>
+                    <button
+                      key={r.name}
+                      type="button"
+                      className="btn btn-sm btn-outline-secondary"
+                      style={{ marginRight: '3px', padding: '0 5px' }}
+                      title={onReact ? `React with :${r.name}:` : `:${r.name}:`}
+                      disabled={!onReact}
+                      onClick={() => onReact(r.name)}
+                    >
+                      {emoji[r.name] && emoji[r.name].indexOf('alias:') !== 0 ?
+                        <img alt={r.name} src={emoji[r.name]} style={{ width: '16px', height: '16px' }} /> :
+                        <span dangerouslySetInnerHTML={{ __html: emojione.shortnameToImage(`:${r.name}:`) }} />
+                      } {r.count}
+                    </button>
+                  )}
+                </div>
+              }
+              {onToggleThread &&
+                // eslint-disable-next-line jsx-a11y/href-no-hash
+                <a href="#" onClick={e => { e.preventDefault(); onToggleThread(); }} style={{ fontSize: '10pt' }}>
+                  {threadOpen && 'Hide thread'}
+                  {!threadOpen && replyCount > 0 && `${replyCount} ${replyCount === 1 ? 'reply' : 'replies'}`}
+                  {!threadOpen && replyCount === 0 && 'Reply in thread'}
+                </a>
+              }
+              {threadOpen && (replies || []).map(reply =>
+                <Message
+                  notifyVisible={() => {}}
+                  emoji={emoji}
+                  key={reply.ts}
+                  users={users}
+                  channels={channels}
+                  msg={reply} />
+              )}
             </div>
           </div>
         </div>
@@ -0,0 +1,81 @@
+import React from 'react';
+import ReactDOM from 'react-dom';
+import Message, { safeUri, segmentMarkdown } from './Message';
+
+const renderCard = msg => {
+  const div = document.createElement('div');
+  ReactDOM.render(<Message notifyVisible={() => {}} users={{}} channels={{ C1: { id: 'C1', name: 'general' } }} emoji={{}} msg={{ ts: '1', ...msg }} />, div);
+  return div;
+};
+const render = msg => renderCard(msg).querySelector('.room-message');
+
+it('renders html in slack text as text', () => {
+  const text = '<img src=x onerror="alert(1)"><script>alert(1)</script>';
+  const el = render({ text: '&lt;img src=x onerror="alert(1)"&gt;', segments: [{ type: 'text', text }] });
+  expect(el.querySelector('img')).toBeNull();
+  expect(el.querySelector('script')).toBeNull();
+  expect(el.textContent).toContain('<img src=x onerror="alert(1)">');
+});
+
+it('renders html in link labels and mentions as text', () => {
+  const el = render({
+    text: 'x',
+    segments: [
+      { type: 'link', text: '<img src=x onerror=alert(1)>', url: 'https://example.com' },
+      { type: 'user', text: '@<b onmouseover=alert(1)>', id: 'U1' },
+    ],
+  });
+  expect(el.querySelector('img')).toBeNull();
+  expect(el.querySelector('b[onmouseover]')).toBeNull();
+  expect(el.querySelector('a').getAttribute('href')).toBe('https://example.com');
+});
+
+it('only links to safe urls', () => {
+  const el = render({
+    text: 'x',
+    segments: [
+      { type: 'link', text: 'click', url: 'javascript:alert(1)' },
+      { type: 'text', text: ' [also](javascript:alert(1)) <javascript:alert(1)>' },
+      { type: 'emoji', text: ':x:', name: 'x', url: 'javascript:alert(1)' },
+    ],
+  });
+  Array.from(el.querySelectorAll('a')).forEach(a => expect(a.getAttribute('href') || '').not.toMatch(/javascript/i));
+  expect(el.querySelector('img')).toBeNull();
+});
+
+it('whitelists link schemes', () => {
+  expect(safeUri('https://example.com')).toBe('https://example.com');
+  expect(safeUri('mailto:bob@example.com')).toBe('mailto:bob@example.com');
+  expect(safeUri('/messages/C1')).toBe('/messages/C1');
+  expect(safeUri('JavaScript:alert(1)')).toBeNull();
+  expect(safeUri('data:text/html,<script>')).toBeNull();
+  expect(safeUri('//evil.example.com')).toBeNull();
+});
+
+it('links channels visitors can see', () => {
+  const channels = { C1: { id: 'C1', name: 'general' } };
+  expect(segmentMarkdown({ type: 'channel', text: '#general', id: 'C1' }, channels)).toBe('[\\#general](/messages/C1)');
+  expect(segmentMarkdown({ type: 'channel', text: '#secret', id: 'C2' }, channels)).toBe('\\#secret');
+});
+
+it('renders blocks instead of their fallback text', () => {
+  const el = renderCard({
+    text: 'fallback',
+    segments: [{ type: 'text', text: 'fallback' }],
+    blocks: [
+      { type: 'header', text: { type: 'plain_text', segments: [{ type: 'text', text: '*News* <b>' }] } },
+      { type: 'section', text: { type: 'mrkdwn', segments: [{ type: 'text', text: 'hi ' }, { type: 'link', text: 'x', url: 'javascript:alert(1)' }] } },
+      { type: 'divider' },
+      { type: 'image', image_url: 'javascript:alert(1)', alt_text: 'bad' },
+      { type: 'image', image_url: 'https://example.com/a.png', alt_text: 'good' },
+    ],
+  });
+  expect(el.textContent).not.toContain('fallback');
+  expect(el.textContent).toContain('*News* <b>');
+  expect(el.querySelector('b')).toBeNull();
+  expect(el.querySelector('hr')).not.toBeNull();
+  Array.from(el.querySelectorAll('a')).forEach(a => expect(a.getAttribute('href') || '').not.toMatch(/javascript/i));
+  const images = Array.from(el.querySelectorAll('img')).map(img => img.getAttribute('src'));
+  expect(images).toContain('https://example.com/a.png');
+  images.forEach(src => expect(src).not.toMatch(/javascript/i));
+});
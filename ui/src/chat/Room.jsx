@@ -7,6 +7,13 @@ import Message from './Message';
 import Api, { ApiListener } from '../lib/api';
 import './Room.css';
 
+// hints for channels visitors can't use normally; see CHANNEL_MODES
+const channelModePlaceholders = {
+  'read-only': 'This channel is read-only.',
+  'post-only': 'Only the team will see what you post here.',
+  'help-desk': 'Ask the team a question; only you and they will see the conversation.',
+};
+
 export default withRouter(class Room extends Component {
 
   static propTypes = {
@@ -36,6 +43,13 @@ export default withRouter(class Room extends Component {
       startTs: moment(),
       messageTs: '',
       messages: [],
+      // parent ts -> replies we've seen, and the thread we're viewing/replying in
+      threads: {},
+      openThread: null,
+      // upload id -> { name, stage, received, total, error } for files we're sharing
+      uploads: {},
+      // slack user id -> username, for the team typing in this channel
+      typing: {},
       switchingChannels: false,
     };
   }
@@ -52,6 +66,9 @@ export default withRouter(class Room extends Component {
     this.toggleSwitchChannels = this.toggleSwitchChannels.bind(this);
     this.changeChannel = this.changeChannel.bind(this);
     this.filterSwitchChannels = this.filterSwitchChannels.bind(this);
+    this.toggleThread = this.toggleThread.bind(this);
+    this.uploadFile = this.uploadFile.bind(this);
+    this.typingTimers = {};
     window.onscroll = this.onScroll.bind(this);
 
     Api.register(new (class RoomListener extends ApiListener {
@@ -63,6 +80,7 @@ export default withRouter(class Room extends Component {
     const { slack: { channel } } = this.state;
     if (!channel) return;
     // console.log('[room.component-did-mount] requesting history for channel', channel);
+    this.subscribeTo(channel.id);
     Api.historicalMessageRequest(channel.id);
   }
   componentWillReceiveProps(nextProps) {
@@ -87,6 +105,7 @@ export default withRouter(class Room extends Component {
       prevProps.match.params.channelID !== this.props.match.params.channelID
     ) {
       // console.log('[room.component-did-update] requesting history for channel', channel, ', was', prevChannel);
+      if (channel) this.subscribeTo(channel.id);
       Api.historicalMessageRequest(this.props.match.params.channelID);
     }
     // if we didn't append a message to our list, don't scroll
@@ -149,14 +168,54 @@ export default withRouter(class Room extends Component {
   }
   handleChange(e) {
     this.setState({ [e.target.name]: e.target.value });
+    if (e.target.name === 'outboundMessage' && e.target.value !== '') this.notifyTyping();
+  }
+  // the server only passes it on every few seconds anyway; see TYPING_INTERVAL
+  notifyTyping() {
+    const { slack: { channel } } = this.state;
+    if (!channel || channel.mode === 'read-only') return;
+    const now = Date.now();
+    if (this.lastTyping && now - this.lastTyping < 3000) return;
+    this.lastTyping = now;
+    Api.sendTyping(channel.id);
+  }
+  stopTyping(userID) {
+    clearTimeout(this.typingTimers[userID]);
+    delete this.typingTimers[userID];
+    if (!this.state.typing[userID]) return;
+    const typing = { ...this.state.typing };
+    delete typing[userID];
+    this.setState({ typing });
   }
   pushOutboundMessage() {
     const { outboundMessage, slack: { channel } } = this.state;
     if (outboundMessage === '' || !channel) return;
-    Api.sendMessage(outboundMessage, channel.id);
+    const nick = /^\/nick\s+(\S+)\s*$/.exec(outboundMessage);
+    const moderation = /^\/(ban|unban)\s+(\S+)\s*$/.exec(outboundMessage);
+    const reaction = /^\/(react|unreact)\s+:?([^:\s]+):?\s*$/.exec(outboundMessage);
+    if (nick) {
+      Api.changeNick(nick[1]);
+    } else if (moderation) {
+      Api.moderate(moderation[1], { username: moderation[2] });
+    } else if (reaction) {
+      // reacts to the latest message
+      const { messages } = this.state;
+      if (messages.length !== 0) Api.react(channel.id, messages[messages.length - 1].ts, reaction[2], reaction[1] === 'unreact');
+    } else {
+      Api.sendMessage(outboundMessage, channel.id, this.state.openThread);
+    }
     this.setState({ outboundMessage: '' });
   }
 
+  uploadFile(e) {
+    const { slack: { channel }, openThread, uploads } = this.state;
+    const file = e.target.files[0];
+    e.target.value = '';
+    if (!file || !channel) return;
+    const uploadId = Api.uploadFile(file, channel.id, openThread);
+    this.setState({ uploads: { ...uploads, [uploadId]: { name: file.name, stage: 'receiving', received: 0, total: file.size } } });
+  }
+
   onScroll() {
     // if user is past scroll threshold, mark read.
     if (!this.pastScrollThreshold()) {
@@ -169,6 +228,33 @@ export default withRouter(class Room extends Component {
     this.setState({ unread: null });
   }
 
+  // live messages only arrive for the channel we're subscribed to
+  subscribeTo(channelID) {
+    if (this.subscribedChannel === channelID) return;
+    if (this.subscribedChannel) Api.unsubscribe(this.subscribedChannel);
+    Api.subscribe(channelID);
+    this.subscribedChannel = channelID;
+  }
+
+  // show a thread under its parent (fetching the replies), and send into it until closed
+  toggleThread(msg) {
+    const { openThread, slack: { channel } } = this.state;
+    if (openThread === msg.ts) {
+      this.setState({ openThread: null });
+      return;
+    }
+    this.setState({ openThread: msg.ts });
+    Api.threadHistoryRequest(channel.id, msg.ts);
+  }
+  addThreadReply(msg) {
+    const { threads, slack: { channel } } = this.state;
+    if (channel && msg.channel.id !== channel.id) return;
+    const replies = threads[msg.thread_ts] || [];
+    if (replies.some(r => r.ts === msg.ts)) return;
+    threads[msg.thread_ts] = replies.concat(msg).sort((a, b) => +a.ts - +b.ts);
+    this.setState({ threads });
+  }
+
   toggleSwitchChannels() {
     this.setState({ switchingChannels: !this.state.switchingChannels, switchChannelText: '' });
   }
@@ -195,7 +281,7 @@ export default withRouter(class Room extends Component {
     switch (msg.type) {
       case 'auth': {
         const { slack } = this.state;
-        slack.user = msg.user;
+        slack.user = { ...msg.user, role: msg.role };
         this.setState({ slack });
         break;
       }
@@ -215,7 +301,11 @@ export default withRouter(class Room extends Component {
           }
         });
 
-        if (!channel) {
+        if (!channel && msg.channels.length === 0) {
+          // nothing we're allowed to see (yet); an invite may open some up
+          // eslint-disable-next-line no-console
+          console.warn('[room.handle-message] no channels available');
+        } else if (!channel) {
           channel = msg.channels[0];
           // TODO grab general channel
           // eslint-disable-next-line no-console
@@ -229,6 +319,8 @@ export default withRouter(class Room extends Component {
         });
         this.setState({
           slack: {
+            // team info is re-sent after auth when it depends on who we are
+            user: this.state.slack.user,
             slack: msg.slack,
             icon: msg.icon,
             users,
@@ -239,16 +331,78 @@ export default withRouter(class Room extends Component {
         });
         break;
       }
+      case 'message-updated':
+      case 'message-deleted': {
+        // patch or drop the message wherever we're showing it, including in threads
+        const { messages, threads, slack: { channel } } = this.state;
+        if (!channel || msg.channel.id !== channel.id) return;
+        const patch = list => list.reduce((patched, m) => {
+          if (m.ts !== msg.ts) return patched.concat(m);
+          if (msg.type === 'message-deleted') return patched;
+          return patched.concat({ ...m, text: msg.text, segments: msg.segments, edited: msg.edited, reply_count: msg.reply_count, parsed: false });
+        }, []);
+        Object.keys(threads).forEach(ts => { threads[ts] = patch(threads[ts]); });
+        this.setState({ messages: patch(messages), threads });
+        break;
+      }
+      case 'reaction-added':
+      case 'reaction-removed': {
+        const { messages, threads, slack: { channel } } = this.state;
+        if (!channel || msg.channel.id !== channel.id) return;
+        const delta = msg.type === 'reaction-added' ? 1 : -1;
+        const patch = list => list.map(m => {
+          if (m.ts !== msg.ts) return m;
+          const reactions = (m.reactions || []).map(r => ({ ...r }));
+          const found = reactions.find(r => r.name === msg.reaction);
+          if (found) {
+            found.count += delta;
+          } else if (delta > 0) {
+            reactions.push({ name: msg.reaction, count: 1 });
+          }
+          return { ...m, reactions: reactions.filter(r => r.count > 0) };
+        });
+        Object.keys(threads).forEach(ts => { threads[ts] = patch(threads[ts]); });
+        this.setState({ messages: patch(messages), threads });
+        break;
+      }
+      case 'agents-online': {
+        const { slack } = this.state;
+        const known = slack.channels[msg.channel.id];
+        if (!known) break;
+        const updated = { ...known, agents_online: msg.count, agents: msg.agents };
+        this.setState({
+          slack: {
+            ...slack,
+            channels: { ...slack.channels, [updated.id]: updated },
+            channel: slack.channel && slack.channel.id === updated.id ? { ...slack.channel, agents_online: msg.count, agents: msg.agents } : slack.channel,
+          },
+        });
+        break;
+      }
+      case 'typing': {
+        const { slack: { channel } } = this.state;
+        if (!channel || msg.channel.id !== channel.id) break;
+        clearTimeout(this.typingTimers[msg.user.id]);
+        this.typingTimers[msg.user.id] = setTimeout(() => this.stopTyping(msg.user.id), msg.expires_in * 1000);
+        this.setState({ typing: { ...this.state.typing, [msg.user.id]: msg.user.username || 'Someone' } });
+        break;
+      }
       case 'message': {
+        // they're done typing once it's posted
+        if (msg.user && msg.user.id) this.stopTyping(msg.user.id);
         // TODO there's an issue here with missing dropped messages on reconnect
         const { messages, unread, startTs, slack: { channel, user } } = this.state;
-        // TODO edits, emoji, deletes, sorting, etc
+        // TODO emoji, sorting, etc
 
         // we got an invalid or old message, drop it.
         if (msg.ts == null) {
           // eslint-disable-next-line no-console
           // console.log('[room.handle-message] dropping invalid message', msg);
           return;
+        } else if (msg.thread_ts && msg.thread_ts !== msg.ts && !(channel && channel.mode === 'help-desk')) {
+          // replies live under their parent; help-desk channels are a single thread anyway
+          this.addThreadReply(msg);
+          return;
         } else if (messages.length !== 0 && +(messages[messages.length - 1].ts) > +msg.ts) {
           // eslint-disable-next-line no-console
           // console.log('[room.handle-message] dropping old message', msg);
@@ -311,6 +465,39 @@ export default withRouter(class Room extends Component {
         });
         break;
       }
+      case 'upload-progress': {
+        const uploads = { ...this.state.uploads };
+        const upload = uploads[msg.upload_id];
+        // it's either from another tab of ours, or one we've dismissed
+        if (!upload) break;
+        if (msg.stage === 'done') {
+          delete uploads[msg.upload_id];
+        } else {
+          uploads[msg.upload_id] = { ...upload, stage: msg.stage, received: msg.received, total: msg.total || upload.total, error: msg.error };
+        }
+        this.setState({ uploads });
+        break;
+      }
+      case 'message-rejected': {
+        // eslint-disable-next-line no-console
+        console.warn(`[room.handle-message] message to ${msg.channel_id} rejected: ${msg.reason}`);
+        break;
+      }
+      case 'message-warning': {
+        // eslint-disable-next-line no-console
+        console.warn(`[room.handle-message] message to ${msg.channel_id} was changed: ${msg.warning}`);
+        break;
+      }
+      case 'moderation-result': {
+        // eslint-disable-next-line no-console
+        console.log(`[room.handle-message] ${msg.action} ${msg.target}: ${msg.error || 'ok'}`);
+        break;
+      }
+      case 'nick-rejected': {
+        // eslint-disable-next-line no-console
+        console.warn(`[room.handle-message] couldn't change name to ${msg.username}: ${msg.reason}`);
+        break;
+      }
       default: {
         // eslint-disable-next-line no-console
         console.warn('[room.handle-message] unhandled message', msg);
@@ -321,8 +508,11 @@ export default withRouter(class Room extends Component {
 
   render() {
     // TODO show loading while waiting for team info, messages, etc
-    const { handleVisibilityChange, handleChange, pushOutboundMessage, handleEnter, viewUnreadMessages, toggleSwitchChannels, filterSwitchChannels, changeChannel } = this;
-    const { switchChannelText, switchingChannels, unread, slack: { channel, icon, slack, emoji, user, users, channels }, messages, outboundMessage, connectionState, connectionChangeTime } = this.state;
+    const { handleVisibilityChange, handleChange, pushOutboundMessage, handleEnter, viewUnreadMessages, toggleSwitchChannels, filterSwitchChannels, changeChannel, toggleThread, uploadFile } = this;
+    const { switchChannelText, switchingChannels, unread, slack: { channel, icon, slack, emoji, user, users, channels }, messages, threads, openThread, uploads, typing, outboundMessage, connectionState, connectionChangeTime } = this.state;
+    // visitors can't see other people's threads in these
+    const threadable = channel && channel.mode !== 'post-only' && channel.mode !== 'help-desk';
+    const typingNames = Object.keys(typing).map(id => typing[id]);
     return (
       <div style={{ background: '#303E4D' }}>
         <div style={{ position: 'sticky', left: '0', top: '0', right: '0', zIndex: 1, background: '#303E4D' }} className="container">
@@ -365,6 +555,15 @@ export default withRouter(class Room extends Component {
                     </span>
                 )
                 }
+                {channel && !switchingChannels &&
+                  <span
+                    style={{ opacity: '0.6', marginLeft: '10px' }}
+                    title={(channel.agents || []).join(', ')}
+                  >
+                    <FontAwesome name="circle" style={{ color: channel.agents_online ? '#2BAC76' : '#aaa', marginRight: '3px' }} />
+                    {channel.agents_online ? `${channel.agents_online} online` : 'nobody online'}
+                  </span>
+                }
               </h5>
               {switchingChannels &&
                 <div
@@ -420,6 +619,10 @@ export default withRouter(class Room extends Component {
                 key={msg.ts}
                 users={users}
                 channels={channels}
+                replies={threads[msg.ts] || []}
+                threadOpen={openThread === msg.ts}
+                onToggleThread={threadable ? () => toggleThread(msg) : undefined}
+                onReact={threadable ? name => Api.react(channel.id, msg.ts, name) : undefined}
                 msg={msg} />
             )}
             {messages.length === 0 &&
@@ -427,9 +630,18 @@ export default withRouter(class Room extends Component {
                 className="alert alert-info"
                 style={{ width: '100%', display: 'block' }}
               >
-                <i>It looks like there's nothing here!</i>
+                <i>
+                  {channel && (channel.mode === 'post-only' || channel.mode === 'help-desk') ?
+                    "Messages posted here are only visible to you and the team." :
+                    "It looks like there's nothing here!"}
+                </i>
               </span>
             }
+            {typingNames.length !== 0 &&
+              <small style={{ color: '#929191' }}>
+                <i>{typingNames.join(', ')} {typingNames.length === 1 ? 'is' : 'are'} typing...</i>
+              </small>
+            }
           </div>
         </div>
         <div
@@ -446,15 +658,45 @@ export default withRouter(class Room extends Component {
           }} className="container"
         >
           <div id="message-new-controls">
+            {openThread &&
+              <span className="badge badge-pill badge-info" style={{ position: 'absolute', marginTop: '-18px' }}>
+                Replying in thread <FontAwesome name="times" style={{ cursor: 'pointer' }} onClick={() => this.setState({ openThread: null })} />
+              </span>
+            }
+            {Object.keys(uploads).map(id => {
+              const upload = uploads[id];
+              const dismiss = () => {
+                const remaining = { ...this.state.uploads };
+                delete remaining[id];
+                this.setState({ uploads: remaining });
+              };
+              return (
+                <span key={id} className={`badge badge-pill badge-${upload.error ? 'danger' : 'secondary'}`} style={{ position: 'absolute', marginTop: '-18px', right: '15px' }}>
+                  {upload.error ?
+                    `Couldn't share ${upload.name}: ${upload.error}` :
+                    `Sharing ${upload.name}${upload.stage === 'forwarding' ? ' with the team' : ''}... ${upload.total ? Math.min(100, Math.round((upload.received / upload.total) * 100)) : 0}%`}
+                  <FontAwesome name="times" style={{ cursor: 'pointer', marginLeft: '5px' }} onClick={dismiss} />
+                </span>
+              );
+            })}
             <textarea
-              style={{ height: '38px', padding: '2px', display: 'inline-block', width: '80%', verticalAlign: 'top' }}
+              style={{ height: '38px', padding: '2px', display: 'inline-block', width: '72%', verticalAlign: 'top' }}
               onKeyPress={handleEnter}
               value={outboundMessage}
               onChange={handleChange}
               name="outboundMessage"
+              placeholder={channel && channelModePlaceholders[channel.mode]}
               className="form-control"
               id="message-text"
             />
+            <label
+              style={{ width: '8%', verticalAlign: 'top', marginBottom: '0' }}
+              title="Share a file"
+              className={`btn btn-secondary ${(!channel || channel.mode === 'read-only') ? 'disabled' : ''}`}
+            >
+              <FontAwesome name="paperclip" />
+              <input type="file" style={{ display: 'none' }} onChange={uploadFile} disabled={!channel || channel.mode === 'read-only'} />
+            </label>
             <button
               style={{ width: '20%', verticalAlign: 'top' }}
               disabled={!channel || outboundMessage === ''}
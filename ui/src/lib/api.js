@@ -1,17 +1,40 @@
 import jwtDecode from 'jwt-decode';
-import { WS_URI } from './env';
+import { WS_URI, HTTP_URI } from './env';
 
 // TODO wrapper around events and reg/unreg
 class Api {
   constructor() {
+    this.consumeLoginToken();
+    this.consumeInvite();
     this.backoffInterval = 1000;
     this.backoffCurrent = 0;
     this.listeners = [];
+    this.subscriptions = [];
     this.state = WebSocket.CLOSED;
     this.stateChange = this.stateChange.bind(this);
     this.bindSock = this.bindSock.bind(this);
     this.bindSock();
   }
+  // after an oidc login, the server redirects back with our new token in the url fragment
+  // eslint-disable-next-line class-methods-use-this
+  consumeLoginToken() {
+    const match = /^#token=(.+)$/.exec(window.location.hash);
+    if (!match) return;
+    // eslint-disable-next-line no-console
+    console.log('[api.consume-login-token] storing token from login redirect');
+    localStorage.setItem('jwt', decodeURIComponent(match[1]));
+    window.history.replaceState(null, '', window.location.pathname + window.location.search);
+  }
+  // invite links look like /?invite=<token>; hang on to it until the server has seen it
+  // eslint-disable-next-line class-methods-use-this
+  consumeInvite() {
+    const match = /[?&]invite=([^&]+)/.exec(window.location.search);
+    if (!match) return;
+    // eslint-disable-next-line no-console
+    console.log('[api.consume-invite] storing invite from url');
+    localStorage.setItem('invite', decodeURIComponent(match[1]));
+    window.history.replaceState(null, '', window.location.pathname + window.location.hash);
+  }
   // WebSocket.CLOSING,CLOSED,CONNECTING,OPEN
   // eslint-disable-next-line no-confusing-arrow
   getState = () => this.sock ? this.sock.readyState : WebSocket.CLOSED;
@@ -79,6 +102,8 @@ class Api {
   onOpen(...args) {
     this.stateChange();
     this.sendAuthMessage();
+    // a new socket starts without subscriptions
+    this.subscriptions.forEach(channel => this.sendSubscription('subscribe', channel));
     this.listeners.forEach(l => {
       const f = l.onOpen;
       if (typeof f === 'function') f(...args);
@@ -97,9 +122,30 @@ class Api {
           (msg.warning ? `(warning ${msg.warning})` : ''),
         );
         localStorage.setItem('jwt', msg.token);
+        // any invite we sent along is now part of the token
+        localStorage.removeItem('invite');
 
         // pre-process message
-        msg = { type: 'auth', user: jwt.user };
+        msg = { type: 'auth', user: jwt.user, role: jwt.role || 'visitor' };
+      } else if (msg.type === 'auth-error') {
+        // eslint-disable-next-line no-console
+        console.warn(`[api.on-message] auth error (${msg.reason}): ${msg.message}`);
+        localStorage.removeItem('jwt');
+        // unless the server already generated a new identity, it's up to us
+        // eslint-disable-next-line no-alert
+        if (!msg.regenerated && window.confirm(`Your previous identity couldn't be restored (${msg.reason}). Continue with a new anonymous identity?`)) {
+          this.sendAuthMessage();
+        }
+      } else if (msg.type === 'invite-error') {
+        // eslint-disable-next-line no-console
+        console.warn(`[api.on-message] invite rejected: ${msg.message}`);
+        localStorage.removeItem('invite');
+      } else if (msg.type === 'token-expiring') {
+        // re-auth with our current token; the server will hand back a renewed one
+        // eslint-disable-next-line no-console
+        console.log(`[api.on-message] token expiring at ${msg.expires_at}, renewing`);
+        this.sendAuthMessage();
+        return;
       }
 
       // otherwise, let our attached listeners handle it
@@ -132,14 +178,73 @@ class Api {
       console.log('[api.send-auth-message] sending anonymous auth request');
     }
 
-    this.sock.send(JSON.stringify({ type: 'auth', token }));
+    const invite = localStorage.getItem('invite');
+    this.sock.send(JSON.stringify({ type: 'auth', token, invite }));
+  }
+  changeNick(username) {
+    this.sock.send(JSON.stringify({ type: 'nick', username }));
+  }
+  moderate(action, params) {
+    this.sock.send(JSON.stringify({ ...params, type: 'moderate', action }));
+  }
+  // only channels we're subscribed to get live messages
+  subscribe(channel) {
+    if (this.subscriptions.indexOf(channel) !== -1) return;
+    this.subscriptions.push(channel);
+    this.sendSubscription('subscribe', channel);
+  }
+  unsubscribe(channel) {
+    const found = this.subscriptions.indexOf(channel);
+    if (found === -1) return;
+    this.subscriptions.splice(found, 1);
+    this.sendSubscription('unsubscribe', channel);
   }
-  sendMessage(text, channel) {
-    this.sock.send(JSON.stringify({ text, type: 'message', channel_id: channel }));
+  sendSubscription(type, channel) {
+    if (this.getState() !== WebSocket.OPEN) return; // sent on open
+    this.sock.send(JSON.stringify({ type, channel_id: channel }));
+  }
+  sendMessage(text, channel, threadTs) {
+    const msg = { text, type: 'message', channel_id: channel };
+    if (threadTs) msg.thread_ts = threadTs;
+    this.sock.send(JSON.stringify(msg));
+  }
+  sendTyping(channel) {
+    if (this.getState() !== WebSocket.OPEN) return;
+    this.sock.send(JSON.stringify({ type: 'typing', channel_id: channel }));
+  }
+  react(channel, ts, reaction, remove) {
+    this.sock.send(JSON.stringify({ type: 'react', channel_id: channel, ts, reaction, remove: remove ? 'true' : 'false' }));
+  }
+  threadHistoryRequest(channel, threadTs) {
+    this.sock.send(JSON.stringify({ type: 'thread-history', channel_id: channel, thread_ts: threadTs }));
   }
   historicalMessageRequest(channel) {
     this.sock.send(JSON.stringify({ type: 'history', channel_id: channel }));
   }
+  // shares a file into slack. progress comes back over the socket as
+  // upload-progress messages with the returned upload id.
+  // eslint-disable-next-line class-methods-use-this
+  uploadFile(file, channel, threadTs, comment) {
+    const uploadId = `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+    const form = new FormData();
+    // the server checks where it's going before reading the file, so fields go first
+    form.append('channel_id', channel);
+    if (threadTs) form.append('thread_ts', threadTs);
+    if (comment) form.append('comment', comment);
+    form.append('file', file, file.name);
+    fetch(`${HTTP_URI}/uploads`, {
+      method: 'POST',
+      headers: { Authorization: `Bearer ${localStorage.getItem('jwt')}`, 'X-Upload-ID': uploadId },
+      body: form,
+    }).then(res => {
+      // eslint-disable-next-line no-console
+      if (!res.ok) console.warn(`[api.upload-file] upload ${uploadId} failed: ${res.status} ${res.statusText}`);
+    }).catch(e => {
+      // eslint-disable-next-line no-console
+      console.error(`[api.upload-file] upload ${uploadId} failed`, e);
+    });
+    return uploadId;
+  }
 }
 
 /* eslint-disable class-methods-use-this */
@@ -1,4 +1,6 @@
-// eslint-disable-next-line import/prefer-default-export
 export const WS_URI =
   process.env.REACT_APP_BACKEND_URI ? process.env.REACT_APP_BACKEND_URI :
     `ws${window.location.protocol === 'https:' ? 's' : ''}://${window.location.hostname === 'localhost' ? 'localhost:3000' : window.location.host}/stream`;
+
+// plain http requests (eg: /files/) go to the same backend as the websocket
+export const HTTP_URI = WS_URI.replace(/^ws/, 'http').replace(/\/stream$/, '');